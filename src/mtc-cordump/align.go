@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"strconv"
+	"time"
+
+	"mtclib"
+)
+
+// binlogEnd returns the end of the binlog of a node whose sql_thread is
+// stopped, which its slave can be aligned to. It returns "" if the binlog
+// doesn't reflect replicated events, as binlog or log_slave_updates is
+// disabled.
+func binlogEnd(node *Node) (file string, pos int64, err os.Error) {
+	rows, _, err := node.db.Query("SELECT @@log_slave_updates")
+	if err != nil {
+		return "", 0, fmt.Errorf("'SELECT @@log_slave_updates' on %v: %v",
+			node, err)
+	}
+	if rows[0].Str(0) != "1" {
+		log.Warn("log_slave_updates is disabled on %v, its slave can't be "+
+			"aligned", node)
+		return "", 0, nil
+	}
+	rows, _, err = node.db.Query("SHOW MASTER STATUS")
+	if err != nil {
+		return "", 0, fmt.Errorf("'SHOW MASTER STATUS' on %v: %v", node, err)
+	}
+	if len(rows) == 0 {
+		log.Warn("binlog is disabled on %v, its slave can't be aligned", node)
+		return "", 0, nil
+	}
+	pos, err = strconv.Atoi64(rows[0].Str(1))
+	if err != nil {
+		return "", 0, fmt.Errorf("bad binlog position on %v: %v", node, err)
+	}
+	return rows[0].Str(0), pos, nil
+}
+
+// runUntil lets the sql_thread of node run until it has executed its
+// master's binlog up to file and pos exactly, then stay stopped there. The
+// sql_thread should be running.
+func runUntil(node *Node, file string, pos int64) os.Error {
+	log.Info("stopping sql_thread of %v at %v %v", node, file, pos)
+	if _, _, err := node.db.Query("STOP SLAVE SQL_THREAD"); err != nil {
+		return fmt.Errorf("'STOP SLAVE SQL_THREAD' on %v: %v", node, err)
+	}
+	_, _, err := node.db.Query("START SLAVE SQL_THREAD UNTIL "+
+		"MASTER_LOG_FILE = '%v', MASTER_LOG_POS = %v",
+		node.db.EscapeString(file), pos)
+	if err != nil {
+		return fmt.Errorf("'START SLAVE UNTIL' on %v: %v", node, err)
+	}
+	// MASTER_POS_WAIT returns NULL if the sql_thread has already stopped,
+	// the slave status tells anyway
+	_, _, err = node.db.Query("SELECT MASTER_POS_WAIT('%v', %v, %v)",
+		node.db.EscapeString(file), pos, *untilWait)
+	if err != nil {
+		return fmt.Errorf("'SELECT MASTER_POS_WAIT()' on %v: %v", node, err)
+	}
+	// the sql_thread stops by itself once the position is reached
+	deadline := time.Nanoseconds() + int64(*untilWait)*1e9
+	for {
+		status, err := mtclib.SlaveStatus(node.db)
+		if err != nil {
+			return fmt.Errorf("'SHOW SLAVE STATUS' on %v: %v", node, err)
+		}
+		if status["Slave_SQL_Running"] != "Yes" {
+			execPos, _ := strconv.Atoi64(status["Exec_Master_Log_Pos"])
+			if status["Relay_Master_Log_File"] != file || execPos != pos {
+				return fmt.Errorf("sql_thread of %v stopped at %v %v "+
+					"instead of %v %v: %v", node,
+					status["Relay_Master_Log_File"], execPos, file, pos,
+					status["Last_SQL_Error"])
+			}
+			return nil
+		}
+		if time.Nanoseconds() > deadline {
+			return fmt.Errorf("sql_thread of %v didn't reach %v %v in %v "+
+				"seconds", node, file, pos, *untilWait)
+		}
+		time.Sleep(1e8)
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"strconv"
+
+	"mtclib"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// integer types a primary key should be of to be chunked
+var intTypes = map[string]bool{
+	"tinyint":   true,
+	"smallint":  true,
+	"mediumint": true,
+	"int":       true,
+	"bigint":    true,
+}
+
+// chunkKey returns the primary key column of a table, or "" if the primary
+// key is missing, composite or not an integer.
+func chunkKey(db *mysql.MySQL, dbName, tbName string) (string, os.Error) {
+	rows, _, err := db.Query("SELECT k.COLUMN_NAME, c.DATA_TYPE "+
+		"FROM information_schema.KEY_COLUMN_USAGE k "+
+		"JOIN information_schema.COLUMNS c "+
+		"ON c.TABLE_SCHEMA = k.TABLE_SCHEMA AND c.TABLE_NAME = k.TABLE_NAME "+
+		"AND c.COLUMN_NAME = k.COLUMN_NAME "+
+		"WHERE k.TABLE_SCHEMA = '%v' AND k.TABLE_NAME = '%v' "+
+		"AND k.CONSTRAINT_NAME = 'PRIMARY'",
+		db.EscapeString(dbName), db.EscapeString(tbName))
+	if err != nil {
+		return "", err
+	}
+	if len(rows) != 1 || !intTypes[rows[0].Str(1)] {
+		return "", nil
+	}
+	return rows[0].Str(0), nil
+}
+
+// chunkRanges splits a table by ranges of its integer primary key, of about
+// *chunkRows rows each as estimated by information_schema. It returns nil if
+// the table is not larger than a single chunk.
+func chunkRanges(db *mysql.MySQL, dbName, tbName, key string) (
+	[]string, os.Error) {
+
+	rows, _, err := db.Query("SELECT TABLE_ROWS FROM information_schema.TABLES "+
+		"WHERE TABLE_SCHEMA = '%v' AND TABLE_NAME = '%v'",
+		db.EscapeString(dbName), db.EscapeString(tbName))
+	if err != nil {
+		return nil, err
+	}
+	estimated, _ := strconv.Atoi64(rows[0].Str(0))
+	if estimated <= int64(*chunkRows) {
+		return nil, nil
+	}
+	rows, _, err = db.Query("SELECT MIN(%v), MAX(%v) FROM %v.%v",
+		mtclib.QuoteName(key), mtclib.QuoteName(key),
+		mtclib.QuoteName(dbName), mtclib.QuoteName(tbName))
+	if err != nil {
+		return nil, err
+	}
+	if rows[0].Data[0] == nil {
+		// empty table
+		return nil, nil
+	}
+	min, err1 := strconv.Atoi64(rows[0].Str(0))
+	max, err2 := strconv.Atoi64(rows[0].Str(1))
+	if err1 != nil || err2 != nil || max-min < 0 {
+		log.Warn("primary key range of %v.%v is too wide to be chunked",
+			mtclib.QuoteName(dbName), mtclib.QuoteName(tbName))
+		return nil, nil
+	}
+	n := (estimated + int64(*chunkRows) - 1) / int64(*chunkRows)
+	step := (max - min + n) / n
+	ranges := make([]string, 0, n)
+	for lo := min; ; lo += step {
+		hi := lo + step - 1
+		if hi >= max || hi < lo {
+			hi = max
+		}
+		ranges = append(ranges, fmt.Sprintf("%v BETWEEN %v AND %v",
+			mtclib.QuoteName(key), lo, hi))
+		if hi == max {
+			break
+		}
+	}
+	return ranges, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"bufio"
+	"fmt"
+	"strings"
+
+	"mtclib"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// maximum length of a single extended INSERT statement
+const maxInsertLen = 1024 * 1024
+
+// databases which are never dumped
+var systemDbs = map[string]bool{
+	"information_schema": true,
+	"performance_schema": true,
+}
+
+func isNumeric(field *mysql.Field) bool {
+	switch field.Type {
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_LONG,
+		mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONGLONG,
+		mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_DOUBLE,
+		mysql.MYSQL_TYPE_DECIMAL, mysql.MYSQL_TYPE_NEWDECIMAL,
+		mysql.MYSQL_TYPE_YEAR:
+		return true
+	}
+	return false
+}
+
+// sqlValue formats a column value of a text protocol row as a SQL literal.
+func sqlValue(db *mysql.MySQL, field *mysql.Field, val interface{}) string {
+	if val == nil {
+		return "NULL"
+	}
+	if isNumeric(field) {
+		return string(val.([]byte))
+	}
+	if field.Type == mysql.MYSQL_TYPE_BIT {
+		return fmt.Sprintf("0x%x", val.([]byte))
+	}
+	return "'" + db.EscapeString(string(val.([]byte))) + "'"
+}
+
+func writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "-- mtc-cordump of %v\n", &nodes[0])
+	fmt.Fprintf(w, "--\n-- Replication chain coordinates:\n--\n")
+	for _, c := range chainCoordinates() {
+		fmt.Fprintf(w, "-- %v\n", c)
+	}
+	writeSession(w)
+}
+
+// writeSession writes session settings which make the dump faster to load.
+func writeSession(w *bufio.Writer) {
+	fmt.Fprintf(w, "\n/*!40101 SET NAMES utf8 */;\n")
+	fmt.Fprintf(w, "/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, "+
+		"UNIQUE_CHECKS=0 */;\n")
+	fmt.Fprintf(w, "/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, "+
+		"FOREIGN_KEY_CHECKS=0 */;\n")
+	fmt.Fprintf(w, "/*!40101 SET @OLD_SQL_MODE=@@SQL_MODE, "+
+		"SQL_MODE='NO_AUTO_VALUE_ON_ZERO' */;\n")
+}
+
+func writeFooter(w *bufio.Writer) {
+	fmt.Fprintf(w, "\n/*!40101 SET SQL_MODE=@OLD_SQL_MODE */;\n")
+	fmt.Fprintf(w, "/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;\n")
+	fmt.Fprintf(w, "/*!40014 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS */;\n")
+	fmt.Fprintf(w, "\n-- Dump completed\n")
+}
+
+func writeCreateDatabase(db *mysql.MySQL, w *bufio.Writer, dbName string) os.Error {
+	rows, _, err := db.Query("SHOW CREATE DATABASE IF NOT EXISTS " +
+		mtclib.QuoteName(dbName))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n--\n-- Database %v\n--\n\n%v;\n",
+		mtclib.QuoteName(dbName), rows[0].Str(1))
+	return nil
+}
+
+func writeCreateTable(db *mysql.MySQL, w *bufio.Writer, dbName, tbName string) os.Error {
+	name := mtclib.QuoteName(dbName) + "." + mtclib.QuoteName(tbName)
+	rows, _, err := db.Query("SHOW CREATE TABLE " + name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n--\n-- Table structure for %v\n--\n\n", name)
+	fmt.Fprintf(w, "DROP TABLE IF EXISTS %v;\n%v;\n",
+		mtclib.QuoteName(tbName), rows[0].Str(1))
+	return nil
+}
+
+// dumpRows writes rows of a table matching cond (all rows if cond is empty) as
+// INSERT statements to w, and returns the number of rows dumped.
+func dumpRows(db *mysql.MySQL, w *bufio.Writer, dbName, tbName, cond string) (
+	rows int64, err os.Error) {
+
+	name := mtclib.QuoteName(dbName) + "." + mtclib.QuoteName(tbName)
+	query := "SELECT * FROM " + name
+	if cond != "" {
+		query += " WHERE " + cond
+	}
+	res, err := db.Start(query)
+	if err != nil {
+		return
+	}
+	if cond != "" {
+		fmt.Fprintf(w, "\n--\n-- Data for %v WHERE %v\n--\n\n", name, cond)
+	} else {
+		fmt.Fprintf(w, "\n--\n-- Data for %v\n--\n\n", name)
+	}
+	values := make([]string, len(res.Fields))
+	size := 0
+	for {
+		row, err := res.GetRow()
+		if err != nil {
+			return rows, err
+		}
+		if row == nil {
+			break
+		}
+		rows++
+		for i, field := range res.Fields {
+			values[i] = sqlValue(db, field, row.Data[i])
+		}
+		if size == 0 {
+			size, _ = w.WriteString("INSERT INTO " +
+				mtclib.QuoteName(tbName) + " VALUES ")
+		} else {
+			w.WriteString(",")
+			size++
+		}
+		n, _ := w.WriteString("(" + strings.Join(values, ",") + ")")
+		size += n
+		if size >= maxInsertLen {
+			w.WriteString(";\n")
+			size = 0
+		}
+	}
+	if size > 0 {
+		w.WriteString(";\n")
+	}
+	return
+}
+
+// dumpTable writes structure and data of a table to w, relative to the
+// current database, and returns the number of rows dumped.
+func dumpTable(db *mysql.MySQL, w *bufio.Writer, dbName, tbName string) (
+	rows int64, err os.Error) {
+
+	log.Debug("dumping %v.%v", mtclib.QuoteName(dbName),
+		mtclib.QuoteName(tbName))
+	if err = writeCreateTable(db, w, dbName, tbName); err != nil {
+		return
+	}
+	return dumpRows(db, w, dbName, tbName, "")
+}
+
+// dump writes a SQL dump of the selected databases of db, headed by the chain
+// coordinates, to w. db should be inside a consistent snapshot transaction.
+func dump(db *mysql.MySQL, w *bufio.Writer, dbs []*Database) os.Error {
+	writeHeader(w)
+	for _, database := range dbs {
+		err := writeCreateDatabase(db, w, database.name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "USE %v;\n", mtclib.QuoteName(database.name))
+		for _, tbName := range database.tables {
+			_, err = dumpTable(db, w, database.name, tbName)
+			if err != nil {
+				return err
+			}
+		}
+		log.Info("database %v dumped", mtclib.QuoteName(database.name))
+	}
+	writeFooter(w)
+	return nil
+}
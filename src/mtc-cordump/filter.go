@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"regexp"
+	"strings"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// Database is a database selected to be dumped, with its selected tables.
+type Database struct {
+	name   string
+	tables []string
+}
+
+// namePattern is an entry of the -d/-D/-t/-T lists. Names may contain
+// wildcards: '*' or '%' matches any sequence of characters, '?' matches any
+// single character. '_' is matched literally.
+type namePattern struct {
+	text    string // as given on the command line
+	db      *regexp.Regexp
+	tb      *regexp.Regexp // nil for database patterns
+	literal bool           // contains no wildcard
+	matched bool
+}
+
+// filter selects databases by dbInc/dbExc and tables by tbInc/tbExc, an empty
+// include list selects everything.
+type filter struct {
+	dbInc, dbExc []*namePattern
+	tbInc, tbExc []*namePattern
+}
+
+func compileName(name string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(name)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, "%", ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// parsePatterns parses a ',' delimited list of "db" names, or "db.tb" names
+// if table is true, in which case a name without db part matches the table in
+// any database.
+func parsePatterns(list string, table bool) []*namePattern {
+	patterns := make([]*namePattern, 0)
+	if list == "" {
+		return patterns
+	}
+	for _, text := range strings.Split(list, ",") {
+		text = strings.TrimSpace(text)
+		pattern := &namePattern{text: text,
+			literal: strings.IndexAny(text, "*%?") < 0}
+		db, tb := text, ""
+		if table {
+			db, tb = "*", text
+			if i := strings.Index(text, "."); i >= 0 {
+				db, tb = text[:i], text[i+1:]
+			}
+			if tb == "" {
+				panic(fmt.Sprintf("mulformed table name: '%v'", text))
+			}
+			pattern.tb = compileName(tb)
+		}
+		if db == "" {
+			panic(fmt.Sprintf("mulformed database name: '%v'", text))
+		}
+		pattern.db = compileName(db)
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+func newFilter() *filter {
+	return &filter{
+		dbInc: parsePatterns(*dumpDb, false),
+		dbExc: parsePatterns(*dumpDbExc, false),
+		tbInc: parsePatterns(*dumpTb, true),
+		tbExc: parsePatterns(*dumpTbExc, true)}
+}
+
+// matchAny reports whether any of the patterns matches, every matched pattern
+// is marked for validation.
+func matchAny(patterns []*namePattern, db, tb string) bool {
+	found := false
+	for _, pattern := range patterns {
+		if pattern.db.MatchString(db) &&
+			(pattern.tb == nil || pattern.tb.MatchString(tb)) {
+			pattern.matched = true
+			found = true
+		}
+	}
+	return found
+}
+
+func (f *filter) selectDb(db string) bool {
+	inc := len(f.dbInc) == 0 || matchAny(f.dbInc, db, "")
+	exc := matchAny(f.dbExc, db, "")
+	return inc && !exc
+}
+
+func (f *filter) selectTb(db, tb string) bool {
+	inc := len(f.tbInc) == 0 || matchAny(f.tbInc, db, tb)
+	exc := matchAny(f.tbExc, db, tb)
+	return inc && !exc
+}
+
+// unknown returns names which match nothing. Wildcard patterns are only
+// required to match something in include lists.
+func (f *filter) unknown() []string {
+	names := make([]string, 0)
+	for _, list := range [][]*namePattern{f.dbInc, f.tbInc} {
+		for _, pattern := range list {
+			if !pattern.matched {
+				names = append(names, pattern.text)
+			}
+		}
+	}
+	for _, list := range [][]*namePattern{f.dbExc, f.tbExc} {
+		for _, pattern := range list {
+			if pattern.matched {
+				continue
+			}
+			if pattern.literal {
+				names = append(names, pattern.text)
+			} else {
+				log.Debug("exclusion '%v' matches nothing", pattern.text)
+			}
+		}
+	}
+	return names
+}
+
+// selectTables resolves the filters against information_schema of db and
+// returns databases and base tables to be dumped. Names which don't exist on
+// db are reported as an error.
+func selectTables(db *mysql.MySQL, f *filter) ([]*Database, os.Error) {
+	rows, _, err := db.Query("SELECT SCHEMA_NAME " +
+		"FROM information_schema.SCHEMATA ORDER BY SCHEMA_NAME")
+	if err != nil {
+		return nil, err
+	}
+	dbs := make([]*Database, 0, len(rows))
+	dbMap := make(map[string]*Database, len(rows))
+	for _, row := range rows {
+		name := row.Str(0)
+		if systemDbs[name] || !f.selectDb(name) {
+			continue
+		}
+		dbMap[name] = &Database{name: name, tables: make([]string, 0)}
+		dbs = append(dbs, dbMap[name])
+	}
+	rows, _, err = db.Query("SELECT TABLE_SCHEMA, TABLE_NAME " +
+		"FROM information_schema.TABLES WHERE TABLE_TYPE = 'BASE TABLE' " +
+		"ORDER BY TABLE_SCHEMA, TABLE_NAME")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		database, ok := dbMap[row.Str(0)]
+		if !ok || !f.selectTb(database.name, row.Str(1)) {
+			continue
+		}
+		database.tables = append(database.tables, row.Str(1))
+	}
+	if unknown := f.unknown(); len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown database(s) or table(s) on %v: %v",
+			&nodes[0], strings.Join(unknown, ", "))
+	}
+	if len(f.tbInc) > 0 {
+		// only databases holding selected tables
+		selected := make([]*Database, 0, len(dbs))
+		for _, database := range dbs {
+			if len(database.tables) > 0 {
+				selected = append(selected, database)
+			}
+		}
+		dbs = selected
+	}
+	return dbs, nil
+}
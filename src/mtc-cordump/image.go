@@ -0,0 +1,311 @@
+package main
+
+import (
+	"os"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"json"
+	"path/filepath"
+	"time"
+
+	"mtclib"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// name of the state file inside of an image directory being dumped
+const stateName = "state.json"
+
+// dumpState is the progress of a dump into an image directory, it is saved
+// after every completed file so an interrupted dump can be resumed.
+type dumpState struct {
+	Time   string               `json:"time"`
+	Format string               `json:"format"`
+	Gzip   int                  `json:"gzip"` // compression level, 0 if none
+	Chain  []*mtclib.Coordinate `json:"chain"`
+	// position of the leaf in its master's binlog
+	MasterFile string             `json:"master_file"`
+	MasterPos  int64              `json:"master_pos"`
+	Files      []*mtclib.DumpFile `json:"files"`
+	Done       map[string]bool    `json:"done"` // completed file names
+}
+
+func readState(dir string) (*dumpState, os.Error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateName))
+	if err != nil {
+		return nil, err
+	}
+	state := new(dumpState)
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("bad state file in %v: %v", dir, err)
+	}
+	return state, nil
+}
+
+// write saves the state into dir, the previous state is replaced atomically.
+func (state *dumpState) write(dir string) os.Error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, stateName+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, stateName))
+}
+
+// fileJob is a file of the image dumped by a worker of dumpImage.
+// Results are kept in the job until the main goroutine records them, as the
+// state may be saved meanwhile.
+type fileJob struct {
+	file    *mtclib.DumpFile
+	rows    int64
+	sum     string // SHA-256
+	elapsed int64  // in nanoseconds
+	err     os.Error
+}
+
+// fileName encodes a database or table name as a portable file name, bytes
+// other than [0-9A-Za-z_$-] are written as '@' followed by their hex value.
+func fileName(name string) string {
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			'0' <= c && c <= '9' || c == '_' || c == '$' || c == '-' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "@%02x", c)
+		}
+	}
+	return buf.String()
+}
+
+// writeFile creates the file at path and lets fn fill it through a buffered
+// writer, compressed by gzip at level unless level is 0. It returns the
+// SHA-256 of the file.
+func writeFile(path string, level int, fn func(w *bufio.Writer) os.Error) (
+	string, os.Error) {
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	out, err := newOutStream(file, level)
+	if err != nil {
+		return "", err
+	}
+	if err = fn(out.Writer); err != nil {
+		return "", err
+	}
+	if err = out.Close(); err != nil {
+		return "", err
+	}
+	return out.Sum(), nil
+}
+
+// planImage lists files of the image for the selected databases in the
+// format and compression of state. With *chunkRows set, tables with an
+// integer primary key are split into chunks. With a text format, the data of
+// every table goes to files separated from its structure, like chunks. db
+// should be inside the dump snapshot.
+func planImage(db *mysql.MySQL, dbs []*Database, state *dumpState) (
+	[]*mtclib.DumpFile, os.Error) {
+
+	format, suffix := state.Format, ""
+	if state.Gzip > 0 {
+		suffix = ".gz"
+	}
+	files := make([]*mtclib.DumpFile, 0)
+	for _, database := range dbs {
+		files = append(files, &mtclib.DumpFile{
+			Name: fileName(database.name) + ".sql" + suffix,
+			Db:   database.name})
+		for _, tbName := range database.tables {
+			prefix := fileName(database.name) + "." + fileName(tbName)
+			var ranges []string
+			if *chunkRows > 0 {
+				key, err := chunkKey(db, database.name, tbName)
+				if err != nil {
+					return nil, err
+				}
+				if key != "" {
+					ranges, err = chunkRanges(db, database.name, tbName, key)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			if format != mtclib.FORMAT_SQL && len(ranges) == 0 {
+				ranges = []string{""}
+			}
+			files = append(files, &mtclib.DumpFile{
+				Name:   prefix + ".sql" + suffix,
+				Db:     database.name,
+				Table:  tbName,
+				Chunks: len(ranges)})
+			for i, cond := range ranges {
+				name := fmt.Sprintf("%v.%05d.%v", prefix, i+1, format)
+				if cond == "" {
+					name = prefix + "." + format
+				}
+				files = append(files, &mtclib.DumpFile{
+					Name:   name + suffix,
+					Db:     database.name,
+					Table:  tbName,
+					Chunk:  i + 1,
+					Chunks: len(ranges),
+					Range:  cond})
+			}
+			if len(ranges) > 1 {
+				log.Debug("%v.%v is split into %v chunks",
+					mtclib.QuoteName(database.name),
+					mtclib.QuoteName(tbName), len(ranges))
+			}
+		}
+	}
+	return files, nil
+}
+
+// dumpFile writes a file of the image to w, data files are written in format.
+func dumpFile(db *mysql.MySQL, w *bufio.Writer, file *mtclib.DumpFile,
+	format string) (err os.Error) {
+
+	switch {
+	case file.Chunk > 0 && format != mtclib.FORMAT_SQL:
+		file.Rows, err = dumpText(db, w, file.Db, file.Table, file.Range,
+			format)
+		return
+	case file.Table == "":
+		return writeCreateDatabase(db, w, file.Db)
+	case file.Chunks == 0:
+		writeSession(w)
+		fmt.Fprintf(w, "USE %v;\n", mtclib.QuoteName(file.Db))
+		file.Rows, err = dumpTable(db, w, file.Db, file.Table)
+	case file.Chunk == 0:
+		writeSession(w)
+		fmt.Fprintf(w, "USE %v;\n", mtclib.QuoteName(file.Db))
+		err = writeCreateTable(db, w, file.Db, file.Table)
+	default:
+		writeSession(w)
+		fmt.Fprintf(w, "USE %v;\n", mtclib.QuoteName(file.Db))
+		file.Rows, err = dumpRows(db, w, file.Db, file.Table, file.Range)
+	}
+	if err == nil {
+		writeFooter(w)
+	}
+	return
+}
+
+func aborted(quit <-chan bool) bool {
+	select {
+	case <-quit:
+		return true
+	default:
+	}
+	return false
+}
+
+// dumpWorker dumps files from jobs through db until jobs is drained, every
+// job is sent back to results. Jobs received after quit was closed are
+// skipped.
+func dumpWorker(db *mysql.MySQL, dir string, state *dumpState,
+	jobs <-chan *fileJob, results chan<- *fileJob, quit <-chan bool) {
+
+	for job := range jobs {
+		if aborted(quit) {
+			job.err = os.NewError("aborted")
+			results <- job
+			continue
+		}
+		start := time.Nanoseconds()
+		file := *job.file
+		job.sum, job.err = writeFile(filepath.Join(dir, file.Name),
+			state.Gzip, func(w *bufio.Writer) os.Error {
+				return dumpFile(db, w, &file, state.Format)
+			})
+		job.rows = file.Rows
+		job.elapsed = time.Nanoseconds() - start
+		results <- job
+	}
+}
+
+// dumpImage dumps files of state not done yet into dir concurrently by
+// workers, the state is saved after every completed file. A manifest carrying
+// the chain coordinates is written at last, and the state file is removed.
+func dumpImage(workers []*mysql.MySQL, dir string, state *dumpState) os.Error {
+	jobs := make([]*fileJob, 0, len(state.Files))
+	for _, file := range state.Files {
+		if !state.Done[file.Name] {
+			jobs = append(jobs, &fileJob{file: file})
+		}
+	}
+	if err := state.write(dir); err != nil {
+		return err
+	}
+
+	queue := make(chan *fileJob, len(jobs))
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	results := make(chan *fileJob)
+	quit := make(chan bool)
+	log.Info("dumping %v file(s) into %v with %v worker(s), %v already done",
+		len(jobs), dir, len(workers), len(state.Files)-len(jobs))
+	for _, db := range workers {
+		go dumpWorker(db, dir, state, queue, results, quit)
+	}
+	var err os.Error
+	for done := 1; done <= len(jobs); done++ {
+		job := <-results
+		file := job.file
+		if job.err == nil {
+			file.Rows, file.Sha256 = job.rows, job.sum
+			state.Done[file.Name] = true
+			job.err = state.write(dir)
+		}
+		if job.err != nil {
+			if err == nil {
+				err = fmt.Errorf("failed to dump %v: %v", file.Name, job.err)
+				close(quit)
+			}
+			continue
+		}
+		switch {
+		case file.Table == "":
+			log.Info("[%v/%v] database %v dumped", done, len(jobs),
+				mtclib.QuoteName(file.Db))
+		case file.Chunk > 0:
+			log.Info("[%v/%v] %v.%v chunk %v/%v dumped, %v rows in %.1fs",
+				done, len(jobs), mtclib.QuoteName(file.Db),
+				mtclib.QuoteName(file.Table), file.Chunk, file.Chunks,
+				file.Rows, float64(job.elapsed)/1e9)
+		default:
+			log.Info("[%v/%v] %v.%v dumped, %v rows in %.1fs", done,
+				len(jobs), mtclib.QuoteName(file.Db),
+				mtclib.QuoteName(file.Table), file.Rows,
+				float64(job.elapsed)/1e9)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	manifest := &mtclib.Manifest{
+		Source: state.Chain[len(state.Chain)-1].Addr,
+		Time:   state.Time,
+		Format: state.Format,
+		Chain:  state.Chain,
+		Files:  state.Files}
+	if state.Gzip > 0 {
+		manifest.Compression = mtclib.COMPRESS_GZIP
+	}
+	if err = manifest.Write(dir); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, stateName))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"io/ioutil"
+	"json"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"mtclib"
+)
+
+// name of the journal inside of an image directory being dumped
+const journalName = "journal.json"
+
+// journal records nodes whose sql_thread was stopped by mtc-cordump. It is
+// saved before every STOP SLAVE and after every START SLAVE, so the nodes can
+// be restarted by "mtc-cordump -recover" if the process was killed. The file
+// is removed once no node is left stopped.
+type journal struct {
+	Pid   int            `json:"pid"`
+	Time  string         `json:"time"`
+	Nodes []*journalNode `json:"nodes"`
+
+	path string
+	mu   sync.Mutex
+}
+
+type journalNode struct {
+	Addr string `json:"addr"` // host:port
+	// the leaf is held stopped for an interrupted image to be resumed
+	Held bool `json:"held"`
+}
+
+func newJournal(path string) *journal {
+	return &journal{
+		Pid:   os.Getpid(),
+		Time:  time.LocalTime().Format("2006-01-02 15:04:05"),
+		Nodes: make([]*journalNode, 0),
+		path:  path}
+}
+
+func readJournal(path string) (*journal, os.Error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{path: path}
+	if err = json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("bad journal %v: %v", path, err)
+	}
+	return j, nil
+}
+
+// save writes the journal atomically, or removes it if no node is left.
+// The directory of the journal is created if needed, as the image directory
+// of a new dump is only made after the chain is stopped. j.mu should be held.
+func (j *journal) save() os.Error {
+	if len(j.Nodes) == 0 {
+		err := os.Remove(j.path)
+		if e, ok := err.(*os.PathError); ok && e.Error == os.ENOENT {
+			return nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// add records the node at addr as stopped, it should be called before the
+// node is actually stopped.
+func (j *journal) add(addr string) os.Error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, node := range j.Nodes {
+		if node.Addr == addr {
+			return nil
+		}
+	}
+	j.Nodes = append(j.Nodes, &journalNode{Addr: addr})
+	return j.save()
+}
+
+// hold marks the node at addr as held for the image to be resumed.
+func (j *journal) hold(addr string) os.Error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, node := range j.Nodes {
+		if node.Addr == addr {
+			node.Held = true
+		}
+	}
+	return j.save()
+}
+
+// remove forgets the node at addr once it was restarted.
+func (j *journal) remove(addr string) os.Error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	nodes := make([]*journalNode, 0, len(j.Nodes))
+	for _, node := range j.Nodes {
+		if node.Addr != addr {
+			nodes = append(nodes, node)
+		}
+	}
+	j.Nodes = nodes
+	return j.save()
+}
+
+// stopped returns a copy of the nodes recorded as stopped.
+func (j *journal) stopped() []journalNode {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	nodes := make([]journalNode, 0, len(j.Nodes))
+	for _, node := range j.Nodes {
+		nodes = append(nodes, *node)
+	}
+	return nodes
+}
+
+// restartPaused restarts sql_thread of every node of j through new
+// connections, the login info of a node is given by server. Nodes held for an
+// image to be resumed are kept stopped if keepHeld is set. It is safe to call
+// while the dump is going on in another goroutine.
+func restartPaused(j *journal, server func(addr string) *mtclib.MySQLServer,
+	keepHeld bool) (failed int) {
+
+	for _, node := range j.stopped() {
+		if node.Held && keepHeld {
+			log.Warn("sql_thread of leaf %v is left stopped for the dump to "+
+				"be resumed, restart it with -recover %v if the dump is "+
+				"abandoned", node.Addr, j.path)
+			continue
+		}
+		log.Info("starting sql_thread of %v", node.Addr)
+		db, err := connect(server(node.Addr))
+		if err == nil {
+			_, _, err = db.Query("START SLAVE SQL_THREAD")
+			db.Close()
+		}
+		if err != nil {
+			log.Error("failed to start sql_thread of %v: %v, manual "+
+				"intervention is required", node.Addr, err)
+			failed++
+			continue
+		}
+		if err = j.remove(node.Addr); err != nil {
+			log.Error("failed to update journal %v: %v", j.path, err)
+		}
+	}
+	return
+}
+
+// chainServer returns login info of a node of the chain by its address. It is
+// safe to call while the chain is discovered in another goroutine.
+func chainServer(addr string) *mtclib.MySQLServer {
+	chainLock.Lock()
+	for i := range nodes {
+		if nodes[i].String() == addr {
+			server := nodes[i].server
+			chainLock.Unlock()
+			return &server
+		}
+	}
+	chainLock.Unlock()
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	server := upstreamServer(host, p)
+	return &server
+}
+
+// recoverChain restarts nodes left stopped by a killed mtc-cordump, as
+// recorded in the journal at path. Login info is given by NIDs like a dump.
+func recoverChain(path string) os.Error {
+	j, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+	log.Info("journal of mtc-cordump (pid %v) started at %v, %v node(s) "+
+		"left stopped", j.Pid, j.Time, len(j.Nodes))
+	for _, node := range j.Nodes {
+		if node.Held {
+			dir := filepath.Dir(path)
+			if _, err := os.Stat(filepath.Join(dir, stateName)); err == nil {
+				log.Warn("restarting held leaf %v, the interrupted dump in "+
+					"%v can't be resumed anymore", node.Addr, dir)
+			}
+		}
+	}
+	if failed := restartPaused(j, chainServer, false); failed > 0 {
+		return fmt.Errorf("%v node(s) are still stopped, journal %v is kept",
+			failed, path)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// A new dump journals the chain before its image directory is made.
+func TestJournalNewDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtc-cordump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "image", journalName)
+	j := newJournal(path)
+	if err = j.add("db1:3306"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err = j.add("db2:3306"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err = j.hold("db1:3306"); err != nil {
+		t.Fatalf("hold: %v", err)
+	}
+	saved, err := readJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Nodes) != 2 || !saved.Nodes[0].Held || saved.Nodes[1].Held {
+		t.Errorf("got nodes %v", saved.Nodes)
+	}
+	if err = j.remove("db1:3306"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err = j.remove("db2:3306"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err = os.Stat(path); err == nil {
+		t.Errorf("journal %v is not removed", path)
+	}
+}
@@ -1,6 +1,6 @@
 // mtc-cordump will make a still image of a leaf MySQL instance with
 // point-in-time informations regarding to all preceding instances.
-// 
+//
 // For example, using mtc-cordump to make an still image of a random MySQL
 // instance N3, which itself is inside a replication chain:
 //
@@ -9,7 +9,7 @@
 // Then with the login informations of N1 and N3 and some proper privilege
 // setups on them, mtc-cordump can obtain the dump with point-in-time binlog
 // positions of every preceding instances, like:
-// 
+//
 //     N1: mysql-bin.000005 48471238 "2011-09-12 12:32:49"
 //     N2: mysql-bin.000023 12389772 "2011-09-12 19:21:43"
 //     N3: mysql-bin.000001 21383457 "2011-09-12 08:11:53"
@@ -20,15 +20,19 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"bufio"
 	"flag"
 	"fmt"
-	// "strings"
-	// "strconv"
-	
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
 	"mtclib"
 
 	l4g "log4go.googlecode.com/hg"
-	// mysql "github.com/ziutek/mymysql/v0.3.7"
+	mysql "github.com/ziutek/mymysql/v0.3.7"
 )
 
 var (
@@ -44,90 +48,744 @@ var (
 	dumpTb     *string = fs.String("t", "", "\"db1.tb1,db1.tb2,...\", include only these tables")
 	dumpTbExc  *string = fs.String("T", "", "\"db1.tb1,db1.tb2,...\", exclude these tables")
 	dumpHeight *int    = fs.Int("height", 0, "dump height, default value includes all upstream nodes")
-	nodes      []Node  = make([]Node, 0, 10)
+	untilWait  *int    = fs.Int("wait", 300, "seconds to wait for a node to catch up with its stopped master")
+	planOnly   *bool   = fs.Bool("plan", false, "print the dump plan with missing privileges and estimated sizes, without pausing replication")
+	// flags: output
+	outDir      *string = fs.String("o", "", "dump into this directory, one file per table, instead of stdout")
+	dumpWorkers *int    = fs.Int("w", 4, "number of parallel dump connections, only applies to -o")
+	chunkRows   *int    = fs.Int("chunk", 0, "split tables with an integer primary key into chunks of about this many rows, only applies to -o")
+	resume      *bool   = fs.Bool("resume", false, "resume an interrupted dump in the -o directory")
+	dumpFormat  *string = fs.String("format", mtclib.FORMAT_SQL, "data format: sql|tsv|csv, tsv and csv only apply to -o")
+	gzipLevel   *int    = fs.Int("gzip", 0, "compress output by gzip at this level, 1 (fastest) to 9 (best), 0 for no compression")
+	// flags: recovery
+	journalPath *string = fs.String("journal", "", "journal of stopped sql_threads, default to journal.json in the -o directory, or /tmp/mtc-cordump.PID.journal")
+	recoverFrom *string = fs.String("recover", "", "restart sql_threads left stopped by a killed dump, as recorded in this journal")
+	// flags: credentials
+	credFlags = mtclib.NewCredentialFlags(fs)
+	// flags: inventory
+	invFlags = mtclib.NewInventoryFlags(fs)
+
+	nodes []Node = make([]Node, 0, 10)
+	// guards nodes and used while the chain is discovered, as the signal
+	// goroutine looks up login info of stopped nodes by chainServer
+	chainLock sync.Mutex
+	// sql_thread of the leaf is kept stopped until the image is complete
+	holdLeaf bool
+	// nodes stopped by us
+	paused *journal
+	// login info of upstream nodes keyed by "host:port"
+	overrides = make(map[string]*mtclib.MySQLServer)
+	used      = make(map[string]bool)
+	// databases and tables selection
+	dumpFilter *filter
 
 	// logging controls
 	log = make(l4g.Logger)
 )
 
+// Node is a MySQL instance of the replication chain. nodes[0] is the leaf
+// which the data is taken from, nodes[len(nodes)-1] is the top-most node.
 type Node struct {
 	server     mtclib.MySQLServer
+	db         *mysql.MySQL // nil if this node was never connected
+	stopped    bool         // sql_thread was stopped by us
 	masterHost string
-	masterFile string
-	masterPos  int64
+	masterPort int
+	masterFile string // Relay_Master_Log_File
+	masterPos  int64  // Exec_Master_Log_Pos
+	// point-in-time coordinate of the dump in this node's own binlog
+	logFile string
+	logPos  int64
+	logTime string
+}
+
+func (node *Node) String() string {
+	return fmt.Sprintf("%v:%v", node.server.Host, node.server.Port)
 }
 
 func ParseArgs() {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Error("Arg parsing failed: %v\n", err)
+			log.Close()
+			os.Exit(1)
 		}
 	}()
 
 	fs.Usage = func() {
-		fmt.Printf("Usage:\n")
-		fmt.Printf("  %v [OPTIONS] NID [NID...] > backup_file.sql\n\n",
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %v [OPTIONS] LEAF_NID [NID...] > backup_file.sql\n",
 			cmdname)
-		fmt.Printf("\nOPTION:\n")
+		fmt.Fprintf(os.Stderr, "  %v [OPTIONS] -o DIR LEAF_NID [NID...]\n",
+			cmdname)
+		fmt.Fprintf(os.Stderr, "  %v -recover JOURNAL NID [NID...]\n",
+			cmdname)
+		fmt.Fprintf(os.Stderr, "  %v [OPTIONS] -inventory FILE "+
+			"(-node NAME | -cluster NAME [-role ROLE]) [NID...]\n", cmdname)
+		fmt.Fprintf(os.Stderr, "  %v verify DIR\n\n", cmdname)
+		fmt.Fprintf(os.Stderr, "Upstream nodes are discovered from the leaf's "+
+			"slave status, extra NIDs override\nlogin info of the node with "+
+			"the same host and port.\n")
+		fmt.Fprintf(os.Stderr, "\nOPTION:\n")
 		fs.PrintDefaults()
 	}
 	fs.Parse(os.Args[1:])
-	if fs.NArg() == 0 {
+	logLevel := l4g.INFO
+	if *verbose || *debugMode {
+		logLevel = l4g.DEBUG
+	}
+	log.AddFilter("stderr", logLevel,
+		l4g.NewFormatLogWriter(os.Stderr, "[%d %t] [%L] %M"))
+	if fs.NArg() == 0 && !invFlags.Given() {
 		log.Error("wrong args")
 		fs.Usage()
 		os.Exit(1)
 	}
-	// parse nodes
-	// dumpNodes := fs.Args()
-	// for _, node := range dumpNodes {
-	// 	params := strings.Split(node, ",")
-	// 	for _, param := range params {
-	// 		var host, user, pass string
-	// 		var port int
-	// 		var masterHost, masterFile string
-	// 		tokens := strings.Split(param, "=")
-	// 		if len(tokens) < 2 || len(tokens[1]) == 0 {
-	// 			err := fmt.Sprintf("bad formatted Nid: \"%v\"\n", node)
-	// 			panic(err)
-	// 		}
-	// 		switch tokens[0] {
-	// 		case "h":
-	// 			host = tokens[1]
-	// 		case "P":
-	// 			port, err := strconv.Atoi(tokens[1])
-	// 		}
-
-	// 	}
-	// 	// append(nodes, Node{host: })
-	// }
+	if *dumpWorkers < 1 {
+		panic(fmt.Sprintf("incorrect number of workers: %v", *dumpWorkers))
+	}
+	if *chunkRows < 0 {
+		panic(fmt.Sprintf("incorrect chunk size: %v", *chunkRows))
+	}
+	if *resume && *outDir == "" {
+		panic("-resume requires -o")
+	}
+	if *resume && *planOnly {
+		panic("-plan can't be used with -resume")
+	}
+	switch *dumpFormat {
+	case mtclib.FORMAT_SQL:
+	case mtclib.FORMAT_TSV, mtclib.FORMAT_CSV:
+		if *outDir == "" {
+			panic(fmt.Sprintf("-format %v requires -o", *dumpFormat))
+		}
+	default:
+		panic(fmt.Sprintf("unknown data format: %v", *dumpFormat))
+	}
+	if *gzipLevel < 0 || *gzipLevel > 9 {
+		panic(fmt.Sprintf("incorrect gzip level: %v", *gzipLevel))
+	}
+	holdLeaf = *outDir != "" && *chunkRows > 0
+	if *journalPath == "" {
+		if *outDir != "" {
+			*journalPath = filepath.Join(*outDir, journalName)
+		} else {
+			*journalPath = fmt.Sprintf("/tmp/mtc-cordump.%v.journal",
+				os.Getpid())
+		}
+	}
+	if *untilWait < 1 {
+		panic(fmt.Sprintf("incorrect wait: %v", *untilWait))
+	}
+	if *dumpHeight < 0 {
+		panic(fmt.Sprintf("incorrect dump height: %v", *dumpHeight))
+	}
+	dumpFilter = newFilter()
+	// the leaf, other NIDs only override login info of upstream nodes
+	if err := credFlags.Setup(); err != nil {
+		panic(err.String())
+	}
+	leaf, nids := inventoryLeaf(), fs.Args()
+	if leaf == nil {
+		leaf, nids = parseNid(fs.Arg(0)), fs.Args()[1:]
+		if err := leaf.ResolvePass(); err != nil {
+			panic(err.String())
+		}
+	}
+	nodes = append(nodes, Node{server: *leaf})
+	for _, nid := range nids {
+		if nid == "." {
+			// placeholder of the positional syntax, nothing to override
+			continue
+		}
+		server := parseNid(nid)
+		if server.User == "" {
+			server.User = leaf.User
+		}
+		if err := server.ResolvePass(); err != nil {
+			panic(err.String())
+		}
+		if server.Pass == "" && !server.PassGiven() {
+			server.Pass = leaf.Pass
+		}
+		overrides[fmt.Sprintf("%v:%v", server.Host, server.Port)] = server
+	}
+}
+
+// parseNid parses a NID argument, a bad NID is reported with the usage.
+func parseNid(nid string) *mtclib.MySQLServer {
+	server, err := mtclib.ParseNidErr(nid)
+	if err != nil {
+		log.Error("bad NID: %v", err)
+		fs.Usage()
+		log.Close()
+		os.Exit(1)
+	}
+	return server
+}
+
+// inventoryLeaf returns the leaf selected from the inventory, a single node
+// of role "backup" if only a cluster is given, or nil without -inventory.
+func inventoryLeaf() *mtclib.MySQLServer {
+	servers, err := invFlags.Select("backup")
+	if err != nil {
+		panic(err.String())
+	}
+	if servers == nil {
+		return nil
+	}
+	if len(servers) != 1 {
+		panic(fmt.Sprintf("%v nodes are selected from the inventory, the "+
+			"leaf should be a single node, use -node or -role", len(servers)))
+	}
+	return servers[0]
+}
+
+// upstreamServer returns login info of a discovered upstream node, which
+// defaults to the leaf's user, password, charset and connect timeout unless
+// overridden by a NID or the inventory. Unless the leaf's password was given
+// by its NID, the password is looked up from credential providers first.
+func upstreamServer(host string, port int) mtclib.MySQLServer {
+	addr := fmt.Sprintf("%v:%v", host, port)
+	chainLock.Lock()
+	override, ok := overrides[addr]
+	if ok {
+		used[addr] = true
+	}
+	leaf := nodes[0].server
+	chainLock.Unlock()
+	if ok {
+		return *override
+	}
+	inv, err := invFlags.Lookup(addr)
+	if err != nil {
+		log.Warn("%v, use the leaf's login for %v", err, addr)
+	} else if inv != nil {
+		return *inv
+	}
+	server := mtclib.MySQLServer{
+		Host:    host,
+		Port:    port,
+		User:    leaf.User,
+		Charset: leaf.Charset,
+		Timeout: leaf.Timeout}
+	if !leaf.PassGiven() {
+		if err := server.ResolvePass(); err != nil {
+			log.Warn("%v, use the leaf's password for %v", err, addr)
+		}
+	}
+	if server.Pass == "" {
+		server.Pass = leaf.Pass
+	}
+	return server
+}
+
+func connect(server *mtclib.MySQLServer) (*mysql.MySQL, os.Error) {
+	db := server.New()
+	db.Debug = *debugMode
+	if err := server.Connect(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// connectChain connects to the leaf and walks upward by Master_Host and
+// Master_Port of every node's slave status, until it reaches a node which is
+// not a slave or the dump height is reached. A discovered node which can't be
+// probed ends the walk, its coordinate is still taken from its child.
+// Connections of nodes left out of the chain are closed.
+func connectChain() os.Error {
+	topo := mtclib.NewTopology()
+	topo.Replicas = false
+	topo.Keep = true
+	topo.Login = upstreamServer
+	topo.Connect = connect
+	switch {
+	case *dumpHeight == 1:
+		// only the leaf, a Depth of 0 would be unlimited
+		topo.Masters = false
+	case *dumpHeight > 1:
+		topo.Depth = *dumpHeight - 1
+	}
+	log.Info("discovering the chain from %v", &nodes[0])
+	if err := topo.Discover(&nodes[0].server); err != nil {
+		return err
+	}
+	defer topo.Close()
+	seen := make(map[*mtclib.TopoNode]bool)
+	for t := topo.Nodes[0]; ; {
+		seen[t] = true
+		node := &nodes[len(nodes)-1]
+		if t.DB == nil {
+			log.Warn("can't probe %v: %v, treat it as the root", node,
+				t.Error)
+			break
+		}
+		// closed by closeChain rather than topo.Close
+		node.db, t.DB = t.DB, nil
+		if t.Master == "" {
+			log.Info("%v is not a slave, treat it as the root", node)
+			break
+		}
+		node.masterHost, node.masterPort, _ = mtclib.SplitAddr(t.Master)
+		master := topo.MasterOf(t)
+		if master == nil {
+			log.Info("dump height %v reached", *dumpHeight)
+			break
+		}
+		if seen[master] {
+			log.Warn("circular replication detected at %v, "+
+				"treat %v as the root", master, node)
+			break
+		}
+		log.Debug("%v replicates from %v", node, master)
+		chainLock.Lock()
+		nodes = append(nodes, Node{server: master.Server})
+		chainLock.Unlock()
+		t = master
+	}
+	chainLock.Lock()
+	defer chainLock.Unlock()
+	for addr := range overrides {
+		if !used[addr] {
+			log.Warn("NID %v doesn't match any node of the chain", addr)
+		}
+	}
+	return nil
+}
+
+// stopChain stops sql_thread of every connected slave node, from the top-most
+// one down to the leaf. The top-most slave is stopped wherever it is, every
+// lower node is then let run by 'START SLAVE UNTIL' until it has executed
+// exactly the binlog of its stopped master, so the coordinates of all nodes
+// are aligned. Every stopped node is recorded in the journal.
+func stopChain() os.Error {
+	// end of the binlog of the node stopped last, "" if it can't be
+	// aligned to
+	var untilFile string
+	var untilPos int64
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := &nodes[i]
+		if node.db == nil || node.masterHost == "" {
+			untilFile = ""
+			continue
+		}
+		status, err := mtclib.SlaveStatus(node.db)
+		if err != nil {
+			return fmt.Errorf("'SHOW SLAVE STATUS' on %v: %v", node, err)
+		}
+		if status["Slave_SQL_Running"] != "Yes" {
+			log.Warn("sql_thread of %v isn't running", node)
+		} else {
+			// journaled ahead, so the node is restarted even if we are
+			// killed right after stopping it
+			if err = paused.add(node.String()); err != nil {
+				return fmt.Errorf("can't write journal %v: %v", paused.path,
+					err)
+			}
+			node.stopped = true
+			if untilFile != "" {
+				err = runUntil(node, untilFile, untilPos)
+			} else {
+				log.Info("stopping sql_thread of %v", node)
+				_, _, err = node.db.Query("STOP SLAVE SQL_THREAD")
+				if err != nil {
+					err = fmt.Errorf("'STOP SLAVE SQL_THREAD' on %v: %v",
+						node, err)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if i > 0 {
+			if untilFile, untilPos, err = binlogEnd(node); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resumeChain restarts every sql_thread stopped by stopChain, from the leaf
+// up to the top-most node, and removes them from the journal. The leaf is
+// skipped while holdLeaf is set.
+func resumeChain() {
+	for i := range nodes {
+		node := &nodes[i]
+		if !node.stopped {
+			continue
+		}
+		if i == 0 && holdLeaf {
+			log.Info("sql_thread of leaf %v is held until the dump "+
+				"is complete", node)
+			if err := paused.hold(node.String()); err != nil {
+				log.Error("failed to update journal %v: %v", paused.path, err)
+			}
+			continue
+		}
+		log.Info("starting sql_thread of %v", node)
+		if _, _, err := node.db.Query("START SLAVE SQL_THREAD"); err != nil {
+			log.Error("failed to start sql_thread of %v: %v, restart it "+
+				"with -recover %v", node, err, paused.path)
+			continue
+		}
+		node.stopped = false
+		if err := paused.remove(node.String()); err != nil {
+			log.Error("failed to update journal %v: %v", paused.path, err)
+		}
+	}
+}
+
+func closeChain() {
+	for i := range nodes {
+		if nodes[i].db != nil {
+			nodes[i].db.Close()
+		}
+	}
+}
+
+// captureCoordinates records the point-in-time coordinate of every node. The
+// coordinate of a node is its child's executed position in its binlog, except
+// for the leaf, which uses its own binlog position.
+func captureCoordinates() os.Error {
+	for i := range nodes {
+		node := &nodes[i]
+		if node.db == nil {
+			continue
+		}
+		rows, _, err := node.db.Query("SELECT NOW()")
+		if err != nil {
+			return fmt.Errorf("'SELECT NOW()' on %v: %v", node, err)
+		}
+		now := rows[0].Str(0)
+		if node.masterHost != "" {
+			status, err := mtclib.SlaveStatus(node.db)
+			if err != nil {
+				return fmt.Errorf("'SHOW SLAVE STATUS' on %v: %v", node, err)
+			}
+			node.masterFile = status["Relay_Master_Log_File"]
+			node.masterPos, err = strconv.Atoi64(status["Exec_Master_Log_Pos"])
+			if err != nil {
+				return fmt.Errorf("bad Exec_Master_Log_Pos on %v: %v",
+					node, err)
+			}
+			if i+1 < len(nodes) {
+				master := &nodes[i+1]
+				master.logFile = node.masterFile
+				master.logPos = node.masterPos
+				master.logTime = now
+			}
+		}
+		if i == 0 {
+			rows, _, err = node.db.Query("SHOW MASTER STATUS")
+			if err != nil {
+				return fmt.Errorf("'SHOW MASTER STATUS' on %v: %v", node, err)
+			}
+			if len(rows) == 0 {
+				log.Warn("binlog is disabled on leaf %v", node)
+			} else {
+				node.logFile = rows[0].Str(0)
+				node.logPos, _ = strconv.Atoi64(rows[0].Str(1))
+			}
+			node.logTime = now
+		}
+	}
+	for _, c := range chainCoordinates() {
+		log.Info("%v", c)
+	}
+	return nil
+}
+
+// chainCoordinates returns point-in-time coordinates of the chain, from the
+// root (N1) to the leaf.
+func chainCoordinates() []*mtclib.Coordinate {
+	chain := make([]*mtclib.Coordinate, 0, len(nodes))
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := &nodes[i]
+		chain = append(chain, &mtclib.Coordinate{
+			Name:    fmt.Sprintf("N%v", len(nodes)-i),
+			Addr:    node.String(),
+			LogFile: node.logFile,
+			LogPos:  node.logPos,
+			Time:    node.logTime})
+	}
+	return chain
+}
+
+// startSnapshot starts a consistent snapshot transaction on db.
+func startSnapshot(db *mysql.MySQL) (err os.Error) {
+	_, _, err = db.Query(
+		"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ")
+	if err != nil {
+		return
+	}
+	_, _, err = db.Query("START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */")
+	return
+}
+
+// connectWorkers opens n connections to the leaf, the leaf's own connection
+// included.
+func connectWorkers(n int) ([]*mysql.MySQL, os.Error) {
+	workers := []*mysql.MySQL{nodes[0].db}
+	for len(workers) < n {
+		db, err := connect(&nodes[0].server)
+		if err != nil {
+			closeWorkers(workers)
+			return nil, fmt.Errorf("can't connect to %v: %v", &nodes[0], err)
+		}
+		workers = append(workers, db)
+	}
+	return workers, nil
+}
+
+// closeWorkers closes connections opened by connectWorkers, except the leaf's
+// own connection.
+func closeWorkers(workers []*mysql.MySQL) {
+	for _, db := range workers[1:] {
+		db.Close()
+	}
+}
+
+func commitWorkers(workers []*mysql.MySQL) (err os.Error) {
+	for _, db := range workers {
+		if _, _, err = db.Query("COMMIT"); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// verifyLeaf checks that the leaf stays at the position an interrupted dump
+// recorded in its state, so a resumed dump is consistent with the files
+// already dumped.
+func verifyLeaf(state *dumpState) os.Error {
+	leaf := &nodes[0]
+	coord := state.Chain[len(state.Chain)-1]
+	if leaf.String() != coord.Addr {
+		return fmt.Errorf("the interrupted dump was taken from %v, not %v",
+			coord.Addr, leaf)
+	}
+	status, err := mtclib.SlaveStatus(leaf.db)
+	if err != nil {
+		return fmt.Errorf("'SHOW SLAVE STATUS' on %v: %v", leaf, err)
+	}
+	if status != nil {
+		pos, _ := strconv.Atoi64(status["Exec_Master_Log_Pos"])
+		if status["Slave_SQL_Running"] != "No" ||
+			status["Relay_Master_Log_File"] != state.MasterFile ||
+			pos != state.MasterPos {
+			return fmt.Errorf("sql_thread of leaf %v was restarted after "+
+				"the dump was interrupted, it can't be resumed consistently",
+				leaf)
+		}
+	}
+	rows, _, err := leaf.db.Query("SHOW MASTER STATUS")
+	if err != nil {
+		return fmt.Errorf("'SHOW MASTER STATUS' on %v: %v", leaf, err)
+	}
+	if coord.LogFile != "" {
+		if len(rows) == 0 {
+			return fmt.Errorf("binlog of leaf %v was disabled after the "+
+				"dump was interrupted", leaf)
+		}
+		pos, _ := strconv.Atoi64(rows[0].Str(1))
+		if rows[0].Str(0) != coord.LogFile || pos != coord.LogPos {
+			return fmt.Errorf("binlog of leaf %v moved after the dump was "+
+				"interrupted, it can't be resumed consistently", leaf)
+		}
+	} else if status == nil {
+		return fmt.Errorf("leaf %v is not a slave and its binlog is "+
+			"disabled, can't verify it has not changed", leaf)
+	}
+	return nil
+}
+
+// resumeImage continues an interrupted dump in *outDir. The leaf should be
+// still held at the recorded position, it is released once the image is
+// complete.
+func resumeImage() (err os.Error) {
+	state, err := readState(*outDir)
+	if err != nil {
+		return
+	}
+	leaf := &nodes[0]
+	log.Info("connecting to %v", leaf)
+	if leaf.db, err = connect(&leaf.server); err != nil {
+		return fmt.Errorf("can't connect to %v: %v", leaf, err)
+	}
+	if err = verifyLeaf(state); err != nil {
+		return
+	}
+	for _, c := range state.Chain {
+		log.Info("%v", c)
+	}
+	leaf.stopped = state.MasterFile != ""
+	if leaf.stopped {
+		if err = paused.add(leaf.String()); err != nil {
+			return
+		}
+		if err = paused.hold(leaf.String()); err != nil {
+			return
+		}
+	}
+	workers, err := connectWorkers(*dumpWorkers)
+	if err != nil {
+		return
+	}
+	defer closeWorkers(workers)
+	for _, db := range workers {
+		if err = startSnapshot(db); err != nil {
+			return
+		}
+	}
+	if err = dumpImage(workers, *outDir, state); err != nil {
+		return
+	}
+	if err = commitWorkers(workers); err != nil {
+		return
+	}
+	holdLeaf = false
+	resumeChain()
+	return
+}
+
+func run() (err os.Error) {
+	defer closeChain()
+	defer func() {
+		if err != nil && holdLeaf && nodes[0].stopped {
+			log.Warn("sql_thread of leaf %v is left stopped, resume the "+
+				"dump with -resume, or restart it with -recover %v",
+				&nodes[0], paused.path)
+		}
+	}()
+	if *resume {
+		return resumeImage()
+	}
+	if *outDir != "" {
+		if _, err := os.Stat(filepath.Join(*outDir, stateName)); err == nil {
+			return fmt.Errorf("an interrupted dump is in %v, continue it "+
+				"with -resume or remove it", *outDir)
+		}
+	}
+	if err = connectChain(); err != nil {
+		return
+	}
+	dbs, err := selectTables(nodes[0].db, dumpFilter)
+	if err != nil {
+		return
+	}
+	if *planOnly {
+		return writePlan(bufio.NewWriter(os.Stdout), dbs)
+	}
+	// worker connections are established before pausing replication
+	workers := []*mysql.MySQL{nodes[0].db}
+	if *outDir != "" {
+		if workers, err = connectWorkers(*dumpWorkers); err != nil {
+			return
+		}
+		defer closeWorkers(workers)
+	}
+	defer resumeChain()
+	if err = stopChain(); err != nil {
+		return
+	}
+	if err = captureCoordinates(); err != nil {
+		return
+	}
+	// every worker joins the same snapshot as the leaf's sql_thread is
+	// stopped, then let the chain go
+	for _, db := range workers {
+		if err = startSnapshot(db); err != nil {
+			return
+		}
+	}
+	resumeChain()
+
+	if *outDir != "" {
+		if err = os.MkdirAll(*outDir, 0755); err != nil {
+			return
+		}
+		state := &dumpState{
+			Time:       time.LocalTime().Format("2006-01-02 15:04:05"),
+			Format:     *dumpFormat,
+			Gzip:       *gzipLevel,
+			Chain:      chainCoordinates(),
+			MasterFile: nodes[0].masterFile,
+			MasterPos:  nodes[0].masterPos,
+			Done:       make(map[string]bool)}
+		state.Files, err = planImage(workers[0], dbs, state)
+		if err != nil {
+			return
+		}
+		err = dumpImage(workers, *outDir, state)
+	} else {
+		var out *outStream
+		if out, err = newOutStream(os.Stdout, *gzipLevel); err != nil {
+			return
+		}
+		if err = dump(workers[0], out.Writer, dbs); err != nil {
+			return
+		}
+		if err = out.Close(); err == nil {
+			log.Info("SHA-256 of the dump: %v", out.Sum())
+		}
+	}
+	if err != nil {
+		return
+	}
+	if err = commitWorkers(workers); err != nil {
+		return
+	}
+	holdLeaf = false
+	return
+}
+
+// handleSignals restarts sql_threads stopped by us through new connections,
+// then exits, as the main goroutine may be blocked on a query.
+func handleSignals() {
+	for {
+		switch sig := (<-signal.Incoming).(os.UnixSignal); sig {
+		case os.SIGINT, os.SIGHUP, os.SIGQUIT, os.SIGTERM:
+			log.Error("%v received", sig)
+			restartPaused(paused, chainServer, true)
+			log.Info("aborting...")
+			log.Close()
+			os.Exit(1)
+		}
+	}
 }
 
 func main() {
-	log.AddFilter("stderr", l4g.DEBUG,
-		l4g.NewFormatLogWriter(os.Stderr, "[%d %t] [%L] %M"))
-	defer log.Close()
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyMain()
+		return
+	}
 	ParseArgs()
-
-	// var rootDb *mymysql.MySQL
-	// var leafDb *mymysql.MySQL
-
-	// verify database connectability
-	// if *rootHost != "" {
-	// 	rootAddr := fmt.Sprintf("%v:%v", *rootHost, *rootPort)
-	// 	rootDb = mymysql.New("tcp", "", rootAddr, *rootUser, *rootPass)
-	// 	rootDb.Register("set names utf8")
-	// 	rows, _, err := rootDb.QueryAC("SELECT * FROM mysql.user")
-	// 	if err != nil {
-	// 		log.Error(err)
-	// 		return
-	// 	}
-	// 	// defer log.Info(rootDb)
-	// 	// defer rootDb.Close()
-	// 	// defer log.Info(rootDb)
-	// 	log.Info(len(rows))
-	// 	for i, _ := range rows {
-	// 		log.Info("%v\n", i)
-	// 	}
-	// 	log.Close()
-	// }
+	if *recoverFrom != "" {
+		if err := recoverChain(*recoverFrom); err != nil {
+			log.Error(err)
+			log.Close()
+			os.Exit(1)
+		}
+		log.Info("recovery completed")
+		log.Close()
+		return
+	}
+	paused = newJournal(*journalPath)
+	log.Info("sql_threads stopped by the dump are journaled in %v",
+		paused.path)
+	go handleSignals()
+	if err := run(); err != nil {
+		log.Error(err)
+		log.Info("aborting...")
+		log.Close()
+		os.Exit(1)
+	}
+	if *planOnly {
+		log.Info("plan completed, nothing was dumped")
+	} else {
+		log.Info("dump completed")
+	}
+	log.Close()
 }
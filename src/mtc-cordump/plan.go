@@ -0,0 +1,261 @@
+package main
+
+import (
+	"os"
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"mtclib"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// privileges checks privileges of the current user of a connection, as
+// reported by information_schema.
+type privileges struct {
+	db      *mysql.MySQL
+	grantee string // 'user'@'host'
+	global  map[string]bool
+}
+
+func newPrivileges(db *mysql.MySQL) (*privileges, os.Error) {
+	rows, _, err := db.Query("SELECT CURRENT_USER()")
+	if err != nil {
+		return nil, err
+	}
+	user := rows[0].Str(0)
+	at := strings.LastIndex(user, "@")
+	if at < 0 {
+		return nil, fmt.Errorf("bad CURRENT_USER(): %v", user)
+	}
+	p := &privileges{
+		db: db,
+		grantee: fmt.Sprintf("'%v'@'%v'", db.EscapeString(user[:at]),
+			db.EscapeString(user[at+1:])),
+		global: make(map[string]bool)}
+	rows, _, err = db.Query("SELECT PRIVILEGE_TYPE "+
+		"FROM information_schema.USER_PRIVILEGES WHERE GRANTEE = '%v'",
+		db.EscapeString(p.grantee))
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		p.global[row.Str(0)] = true
+	}
+	return p, nil
+}
+
+// onDb tells if priv is granted globally or on database dbName.
+func (p *privileges) onDb(priv, dbName string) (bool, os.Error) {
+	if p.global[priv] {
+		return true, nil
+	}
+	// database level grants may contain wildcards
+	rows, _, err := p.db.Query("SELECT 1 "+
+		"FROM information_schema.SCHEMA_PRIVILEGES WHERE GRANTEE = '%v' "+
+		"AND PRIVILEGE_TYPE = '%v' AND '%v' LIKE TABLE_SCHEMA",
+		p.db.EscapeString(p.grantee), priv, p.db.EscapeString(dbName))
+	if err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// onTable tells if priv is granted globally, on database dbName or on table
+// tbName.
+func (p *privileges) onTable(priv, dbName, tbName string) (bool, os.Error) {
+	ok, err := p.onDb(priv, dbName)
+	if ok || err != nil {
+		return ok, err
+	}
+	rows, _, err := p.db.Query("SELECT 1 "+
+		"FROM information_schema.TABLE_PRIVILEGES WHERE GRANTEE = '%v' "+
+		"AND PRIVILEGE_TYPE = '%v' AND TABLE_SCHEMA = '%v' "+
+		"AND TABLE_NAME = '%v'", p.db.EscapeString(p.grantee), priv,
+		p.db.EscapeString(dbName), p.db.EscapeString(tbName))
+	if err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// missingPrivileges returns privileges required by the dump which are not
+// granted on a node: REPLICATION CLIENT everywhere, SUPER where the
+// sql_thread is to be stopped, SELECT and LOCK TABLES on the dumped data of
+// the leaf.
+func missingPrivileges(node *Node, leaf bool, dbs []*Database) (
+	[]string, os.Error) {
+
+	p, err := newPrivileges(node.db)
+	if err != nil {
+		return nil, err
+	}
+	missing := make([]string, 0)
+	if !p.global["REPLICATION CLIENT"] && !p.global["SUPER"] {
+		missing = append(missing, "REPLICATION CLIENT")
+	}
+	if node.masterHost != "" && !p.global["SUPER"] {
+		missing = append(missing, "SUPER")
+	}
+	if !leaf {
+		return missing, nil
+	}
+	for _, database := range dbs {
+		ok, err := p.onDb("LOCK TABLES", database.name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, "LOCK TABLES ON "+
+				mtclib.QuoteName(database.name)+".*")
+		}
+		ok, err = p.onDb("SELECT", database.name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+		for _, tbName := range database.tables {
+			ok, err := p.onTable("SELECT", database.name, tbName)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				missing = append(missing, "SELECT ON "+
+					mtclib.QuoteName(database.name)+"."+
+					mtclib.QuoteName(tbName))
+			}
+		}
+	}
+	return missing, nil
+}
+
+// sizeString formats a size in bytes for human.
+func sizeString(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size, i := float64(n), 0
+	for ; size >= 1024 && i < len(units)-1; i++ {
+		size /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%v B", n)
+	}
+	return fmt.Sprintf("%.1f %v", size, units[i])
+}
+
+// writeTablePlan writes the estimated rows and size of every selected table,
+// and the estimated number of chunks with *chunkRows set. It returns the
+// number of non-transactional tables.
+func writeTablePlan(w *bufio.Writer, db *mysql.MySQL, dbs []*Database) (
+	int, os.Error) {
+
+	var tables, totalRows, totalSize int64
+	nonTrx := 0
+	fmt.Fprintf(w, "\nTables (estimated by information_schema):\n")
+	for _, database := range dbs {
+		rows, res, err := db.Query("SELECT TABLE_NAME, ENGINE, TABLE_ROWS, "+
+			"DATA_LENGTH, INDEX_LENGTH FROM information_schema.TABLES "+
+			"WHERE TABLE_SCHEMA = '%v'", db.EscapeString(database.name))
+		if err != nil {
+			return 0, err
+		}
+		stats := make(map[string]*mysql.Row, len(rows))
+		for _, row := range rows {
+			stats[row.Str(res.Map["TABLE_NAME"])] = row
+		}
+		for _, tbName := range database.tables {
+			row, ok := stats[tbName]
+			if !ok {
+				continue
+			}
+			engine := row.Str(res.Map["ENGINE"])
+			n, _ := strconv.Atoi64(row.Str(res.Map["TABLE_ROWS"]))
+			size, _ := strconv.Atoi64(row.Str(res.Map["DATA_LENGTH"]))
+			index, _ := strconv.Atoi64(row.Str(res.Map["INDEX_LENGTH"]))
+			tables++
+			totalRows += n
+			totalSize += size
+			note := ""
+			if engine != "InnoDB" {
+				note = ", not consistent with the coordinates"
+				nonTrx++
+			}
+			if *outDir != "" && *chunkRows > 0 {
+				key, err := chunkKey(db, database.name, tbName)
+				if err != nil {
+					return 0, err
+				}
+				if key != "" && n > int64(*chunkRows) {
+					note += fmt.Sprintf(", about %v chunks by %v",
+						(n+int64(*chunkRows)-1)/int64(*chunkRows),
+						mtclib.QuoteName(key))
+				}
+			}
+			fmt.Fprintf(w, "  %v.%v: %v, %v rows, data %v, index %v%v\n",
+				mtclib.QuoteName(database.name), mtclib.QuoteName(tbName),
+				engine, n, sizeString(size), sizeString(index), note)
+		}
+	}
+	fmt.Fprintf(w, "Total: %v database(s), %v table(s), %v rows, data %v\n",
+		len(dbs), tables, totalRows, sizeString(totalSize))
+	return nonTrx, nil
+}
+
+// writePlan writes what the dump would do into w, without pausing any
+// replication: nodes of the chain and their replication status, missing
+// privileges, and the selected tables with their estimated sizes. It returns
+// an error if the dump is not going to succeed.
+func writePlan(w *bufio.Writer, dbs []*Database) os.Error {
+	problems := 0
+	fmt.Fprintf(w, "Chain (from the root to the leaf):\n")
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := &nodes[i]
+		fmt.Fprintf(w, "  N%v %v", len(nodes)-i, node)
+		switch {
+		case node.db == nil:
+			fmt.Fprintf(w, ": not connected, coordinate from its slave only\n")
+			continue
+		case node.masterHost == "":
+			fmt.Fprintf(w, ": root\n")
+		default:
+			status, err := mtclib.SlaveStatus(node.db)
+			if err != nil {
+				return fmt.Errorf("'SHOW SLAVE STATUS' on %v: %v", node, err)
+			}
+			fmt.Fprintf(w, ": slave of %v:%v, sql_thread %v, %v seconds "+
+				"behind master\n", node.masterHost, node.masterPort,
+				status["Slave_SQL_Running"], status["Seconds_Behind_Master"])
+			if status["Slave_SQL_Running"] != "Yes" {
+				fmt.Fprintf(w, "    sql_thread is not running, "+
+					"the coordinate of its master may be stale\n")
+			}
+		}
+		missing, err := missingPrivileges(node, i == 0, dbs)
+		if err != nil {
+			return fmt.Errorf("can't check privileges on %v: %v", node, err)
+		}
+		if len(missing) > 0 {
+			fmt.Fprintf(w, "    missing privileges: %v\n",
+				strings.Join(missing, ", "))
+			problems++
+		}
+	}
+	nonTrx, err := writeTablePlan(w, nodes[0].db, dbs)
+	if err != nil {
+		return err
+	}
+	if nonTrx > 0 {
+		fmt.Fprintf(w, "\n%v non-InnoDB table(s) will not be consistent "+
+			"with the coordinates\n", nonTrx)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if problems > 0 {
+		return fmt.Errorf("%v node(s) lack required privileges", problems)
+	}
+	return nil
+}
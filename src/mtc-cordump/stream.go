@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// outStream is an output of the dump, optionally gzip compressed. It keeps
+// the SHA-256 of the bytes written out, after compression.
+type outStream struct {
+	*bufio.Writer
+	hash hash.Hash
+	zw   io.WriteCloser // nil if not compressed
+}
+
+// newOutStream returns an outStream writing to w, compressed by gzip at level
+// (1 to 9), or not compressed if level is 0.
+func newOutStream(w io.Writer, level int) (*outStream, os.Error) {
+	s := &outStream{hash: sha256.New()}
+	w = io.MultiWriter(w, s.hash)
+	if level > 0 {
+		zw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		s.zw = zw
+		w = zw
+	}
+	s.Writer = bufio.NewWriter(w)
+	return s, nil
+}
+
+// Close flushes the stream and ends the compressed data, the underlying
+// writer is left open.
+func (s *outStream) Close() os.Error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if s.zw != nil {
+		return s.zw.Close()
+	}
+	return nil
+}
+
+// Sum returns the hex encoded SHA-256 of the stream, it should be called after
+// Close.
+func (s *outStream) Sum() string {
+	return fmt.Sprintf("%x", s.hash.Sum())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"bufio"
+
+	"mtclib"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// writeTSVField writes a value escaped the way LOAD DATA INFILE reads by
+// default.
+func writeTSVField(w *bufio.Writer, val []byte) {
+	for _, c := range val {
+		switch c {
+		case '\\':
+			w.WriteString(`\\`)
+		case '\t':
+			w.WriteString(`\t`)
+		case '\n':
+			w.WriteString(`\n`)
+		case '\r':
+			w.WriteString(`\r`)
+		case 0:
+			w.WriteString(`\0`)
+		default:
+			w.WriteByte(c)
+		}
+	}
+}
+
+// writeCSVField writes a value as a RFC 4180 field, only numeric values are
+// left unquoted.
+func writeCSVField(w *bufio.Writer, field *mysql.Field, val []byte) {
+	if isNumeric(field) {
+		w.Write(val)
+		return
+	}
+	w.WriteByte('"')
+	for _, c := range val {
+		if c == '"' {
+			w.WriteByte('"')
+		}
+		w.WriteByte(c)
+	}
+	w.WriteByte('"')
+}
+
+// dumpText writes rows of a table matching cond (all rows if cond is empty) as
+// tab-separated values, or comma-separated values if format is FORMAT_CSV, one
+// line per row, and returns the number of rows dumped. NULL is written as \N,
+// or as an unquoted NULL in csv, which LOAD DATA INFILE tells from "NULL".
+func dumpText(db *mysql.MySQL, w *bufio.Writer, dbName, tbName, cond string,
+	format string) (rows int64, err os.Error) {
+
+	query := "SELECT * FROM " + mtclib.QuoteName(dbName) + "." +
+		mtclib.QuoteName(tbName)
+	if cond != "" {
+		query += " WHERE " + cond
+	}
+	res, err := db.Start(query)
+	if err != nil {
+		return
+	}
+	sep, eol := "\t", "\n"
+	if format == mtclib.FORMAT_CSV {
+		sep, eol = ",", "\r\n"
+	}
+	for {
+		row, err := res.GetRow()
+		if err != nil {
+			return rows, err
+		}
+		if row == nil {
+			break
+		}
+		rows++
+		for i, field := range res.Fields {
+			if i > 0 {
+				w.WriteString(sep)
+			}
+			switch val := row.Data[i].(type) {
+			case nil:
+				if format == mtclib.FORMAT_CSV {
+					w.WriteString("NULL")
+				} else {
+					w.WriteString(`\N`)
+				}
+			case []byte:
+				if format == mtclib.FORMAT_CSV {
+					writeCSVField(w, field, val)
+				} else {
+					writeTSVField(w, val)
+				}
+			}
+		}
+		w.WriteString(eol)
+	}
+	return
+}
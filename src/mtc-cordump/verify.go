@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"mtclib"
+
+	l4g "log4go.googlecode.com/hg"
+)
+
+// checkGzip reads a compressed file through, so its gzip checksum is verified.
+func checkGzip(path string) os.Error {
+	rd, err := mtclib.OpenFile(path)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	_, err = io.Copy(ioutil.Discard, rd)
+	return err
+}
+
+// verifyFile checks a single file dump, which has no manifest: the content of
+// a compressed dump is checked, and the SHA-256 is logged to be compared with
+// the one logged by the dump.
+func verifyFile(path string) os.Error {
+	if strings.HasSuffix(path, ".gz") {
+		if err := checkGzip(path); err != nil {
+			return fmt.Errorf("%v is corrupted: %v", path, err)
+		}
+	}
+	sum, err := mtclib.Checksum(path)
+	if err != nil {
+		return err
+	}
+	log.Info("SHA-256 of %v: %v", path, sum)
+	return nil
+}
+
+// verifyImage checks every file of the image in dir against the SHA-256
+// recorded in its manifest, compressed files are decompressed as well.
+func verifyImage(dir string) os.Error {
+	if _, err := os.Stat(filepath.Join(dir, stateName)); err == nil {
+		return fmt.Errorf("%v is an interrupted dump, continue it with "+
+			"-resume", dir)
+	}
+	manifest, err := mtclib.ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	bad := 0
+	for i, file := range manifest.Files {
+		path := filepath.Join(dir, file.Name)
+		sum, err := mtclib.Checksum(path)
+		switch {
+		case err != nil:
+			log.Error("[%v/%v] %v: %v", i+1, len(manifest.Files), file.Name,
+				err)
+			bad++
+			continue
+		case file.Sha256 == "":
+			log.Warn("[%v/%v] %v has no checksum recorded", i+1,
+				len(manifest.Files), file.Name)
+		case sum != file.Sha256:
+			log.Error("[%v/%v] %v is corrupted: SHA-256 %v, expected %v",
+				i+1, len(manifest.Files), file.Name, sum, file.Sha256)
+			bad++
+			continue
+		}
+		if strings.HasSuffix(file.Name, ".gz") {
+			if err = checkGzip(path); err != nil {
+				log.Error("[%v/%v] %v is corrupted: %v", i+1,
+					len(manifest.Files), file.Name, err)
+				bad++
+				continue
+			}
+		}
+		log.Debug("[%v/%v] %v is ok", i+1, len(manifest.Files), file.Name)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%v of %v file(s) of %v failed verification", bad,
+			len(manifest.Files), dir)
+	}
+	log.Info("%v file(s) of %v verified", len(manifest.Files), dir)
+	return nil
+}
+
+// verifyMain runs the verify subcommand:
+//
+//     mtc-cordump verify [-v] IMAGE...
+//
+// IMAGE is either an image directory or a single file dump.
+func verifyMain() {
+	vfs := flag.NewFlagSet(cmdname+" verify", flag.ExitOnError)
+	verbose := vfs.Bool("v", false, "verbose output")
+	vfs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %v verify [OPTIONS] IMAGE...\n\n", cmdname)
+		fmt.Fprintf(os.Stderr, "IMAGE is a mtc-cordump output directory or "+
+			"file.\n")
+		fmt.Fprintf(os.Stderr, "\nOPTION:\n")
+		vfs.PrintDefaults()
+	}
+	vfs.Parse(os.Args[2:])
+	logLevel := l4g.INFO
+	if *verbose {
+		logLevel = l4g.DEBUG
+	}
+	log.AddFilter("stderr", logLevel,
+		l4g.NewFormatLogWriter(os.Stderr, "[%d %t] [%L] %M"))
+	if vfs.NArg() == 0 {
+		log.Error("wrong args")
+		vfs.Usage()
+		log.Close()
+		os.Exit(1)
+	}
+	failed := false
+	for _, path := range vfs.Args() {
+		fi, err := os.Stat(path)
+		if err == nil {
+			if fi.IsDirectory() {
+				err = verifyImage(path)
+			} else {
+				err = verifyFile(path)
+			}
+		}
+		if err != nil {
+			log.Error(err)
+			failed = true
+		}
+	}
+	log.Close()
+	if failed {
+		os.Exit(1)
+	}
+}
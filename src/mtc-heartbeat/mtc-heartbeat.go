@@ -0,0 +1,173 @@
+// mtc-heartbeat writes a heartbeat row to the top master of a replication
+// chain every second, for mtc-rplerr-monitor to tell the delay of every
+// replica behind it, e.g.:
+//
+//     mtc-heartbeat -create "h=db1,u=heartbeat,p=xxx"
+package main
+
+import (
+	"os"
+	"os/signal"
+	"flag"
+	"fmt"
+	"time"
+
+	"mtclib"
+
+	l4g "log4go.googlecode.com/hg"
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+var (
+	cmdname = os.Args[0]
+	fs      = flag.NewFlagSet(cmdname, flag.ExitOnError)
+
+	// flags: general
+	verbose   = fs.Bool("v", false, "verbose output")
+	debugMode = fs.Bool("debug", false, "debug mode")
+	// flags: heartbeat
+	table    = fs.String("table", mtclib.HEARTBEAT_TABLE, "heartbeat table, as DB.TABLE")
+	interval = fs.Int("i", 1, "interval between two heartbeats, in seconds")
+	create   = fs.Bool("create", false, "create the heartbeat table if missing")
+	// flags: credentials
+	credFlags = mtclib.NewCredentialFlags(fs)
+	// flags: inventory
+	invFlags = mtclib.NewInventoryFlags(fs)
+
+	server   *mtclib.MySQLServer
+	serverId int64 // of server, read on every connect
+
+	// logging controls
+	log = make(l4g.Logger)
+)
+
+func parseArgs() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("Arg parsing failed: %v\n", err)
+			log.Close()
+			os.Exit(1)
+		}
+	}()
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %v [OPTIONS] NID\n", cmdname)
+		fmt.Fprintf(os.Stderr, "  %v [OPTIONS] -inventory FILE "+
+			"(-node NAME | -cluster NAME [-role ROLE])\n\n", cmdname)
+		fmt.Fprintf(os.Stderr, "A cluster without -role selects its node "+
+			"of role \"master\".\n")
+		fmt.Fprintf(os.Stderr, "\nOPTION:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	logLevel := l4g.INFO
+	if *debugMode {
+		logLevel = l4g.DEBUG
+	} else if !*verbose {
+		logLevel = l4g.WARNING
+	}
+	log.AddFilter("stderr", logLevel,
+		l4g.NewFormatLogWriter(os.Stderr, "[%d %t] [%L] %M"))
+	if *interval <= 0 {
+		panic(fmt.Sprintf("incorrect interval: %v", *interval))
+	}
+	if err := credFlags.Setup(); err != nil {
+		panic(err.String())
+	}
+	servers, err := invFlags.Select("master")
+	if err != nil {
+		panic(err.String())
+	}
+	switch {
+	case servers != nil && fs.NArg() != 0:
+		panic("NID can't be given with -inventory")
+	case servers != nil && len(servers) != 1:
+		panic(fmt.Sprintf("%v nodes selected, heartbeats should be "+
+			"written to the top master only", len(servers)))
+	case servers != nil:
+		server = servers[0]
+		return
+	case fs.NArg() != 1:
+		log.Error("wrong args")
+		fs.Usage()
+		log.Close()
+		os.Exit(1)
+	}
+	if server, err = mtclib.ParseNidErr(fs.Arg(0)); err != nil {
+		log.Error("bad NID: %v", err)
+		fs.Usage()
+		log.Close()
+		os.Exit(1)
+	}
+	if err = server.ResolvePass(); err != nil {
+		panic(err.String())
+	}
+}
+
+// beat writes a heartbeat, connecting db first if needed. db is returned
+// closed if the connection is lost.
+func beat(db *mysql.MySQL) (*mysql.MySQL, os.Error) {
+	if db == nil || !db.IsConnected() {
+		var err os.Error
+		db = server.New()
+		if err = server.Connect(db); err != nil {
+			return nil, err
+		}
+		// the server behind the address may have changed
+		if serverId, err = mtclib.ServerId(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+		log.Info("connected to %v, server_id %v", server.Addr(), serverId)
+		if *create {
+			if err := mtclib.CreateHeartbeat(db, *table); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+	}
+	err := mtclib.WriteHeartbeat(db, *table, serverId)
+	if _, ok := err.(*mysql.Error); err != nil && !ok {
+		db.Close()
+		return nil, err
+	}
+	return db, err
+}
+
+func main() {
+	parseArgs()
+	go func() {
+		for {
+			switch sig := (<-signal.Incoming).(os.UnixSignal); sig {
+			case os.SIGINT, os.SIGHUP, os.SIGQUIT, os.SIGTERM:
+				log.Info("%v received, stopping...", sig)
+				log.Close()
+				os.Exit(0)
+			}
+		}
+	}()
+
+	log.Info("writing heartbeats to %v of %v every %v second(s)...",
+		*table, server.Addr(), *interval)
+	var db *mysql.MySQL
+	var lastErr string // logged once until heartbeats are written again
+	tick := time.Tick(int64(*interval) * 1e9)
+	for {
+		var err os.Error
+		if db, err = beat(db); err != nil {
+			if err.String() != lastErr {
+				log.Warn("can't write heartbeat to %v: %v", server.Addr(), err)
+				lastErr = err.String()
+			}
+		} else {
+			if lastErr != "" {
+				log.Warn("heartbeats written to %v again", server.Addr())
+				lastErr = ""
+			}
+			log.Debug("heartbeat written to %v", server.Addr())
+		}
+		<-tick
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,409 @@
+// mtc-restore loads an image made by mtc-cordump into a MySQL instance, then
+// attaches the instance to any node of the original replication chain by the
+// binlog coordinates recorded in the image.
+//
+// For example, with an image of N3 taken from the chain:
+//
+//     N1 <- N2 <- N3 <- N4   (N3 replicate from N2, etc...)
+//
+// the restored instance can be made a slave of N1, N2 or N3:
+//
+//     mtc-restore --attach-to N1 /backup/n3 "h=new1,u=root,p=xxx"
+package main
+
+import (
+	"os"
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mtclib"
+
+	l4g "log4go.googlecode.com/hg"
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+var (
+	cmdname = os.Args[0]
+	fs      = flag.NewFlagSet(cmdname, flag.ExitOnError)
+
+	// flags: general
+	verbose   = fs.Bool("v", false, "verbose output")
+	debugMode = fs.Bool("debug", false, "debug mode")
+	// flags: loading
+	loadWorkers = fs.Int("w", 4, "number of parallel load connections, only applies to image directories")
+	// flags: attaching
+	attachTo   = fs.String("attach-to", "", "node of the original chain to replicate from, e.g. N1")
+	masterUser = fs.String("master-user", "", "replication user for CHANGE MASTER TO")
+	masterPass = fs.String("master-pass", "", "replication password for CHANGE MASTER TO")
+	startSlave = fs.Bool("start-slave", false, "start replication after CHANGE MASTER TO")
+	// flags: credentials
+	credFlags = mtclib.NewCredentialFlags(fs)
+	// flags: inventory
+	invFlags = mtclib.NewInventoryFlags(fs)
+
+	imagePath string
+	target    *mtclib.MySQLServer
+
+	// logging controls
+	log = make(l4g.Logger)
+)
+
+// loadJob is a table file of an image loaded by a worker of loadImage.
+type loadJob struct {
+	file    *mtclib.DumpFile
+	text    bool  // loaded by LOAD DATA INFILE
+	stmts   int   // statements executed, or rows loaded from a text file
+	elapsed int64 // in nanoseconds
+	err     os.Error
+}
+
+func parseArgs() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("Arg parsing failed: %v\n", err)
+			log.Close()
+			os.Exit(1)
+		}
+	}()
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %v [OPTIONS] IMAGE NID\n", cmdname)
+		fmt.Fprintf(os.Stderr, "  %v [OPTIONS] -inventory FILE "+
+			"(-node NAME | -cluster NAME -role ROLE) IMAGE\n\n", cmdname)
+		fmt.Fprintf(os.Stderr, "IMAGE is a mtc-cordump output file or "+
+			"directory, NID is the target instance.\n")
+		fmt.Fprintf(os.Stderr, "\nOPTION:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	logLevel := l4g.INFO
+	if *verbose || *debugMode {
+		logLevel = l4g.DEBUG
+	}
+	log.AddFilter("stderr", logLevel,
+		l4g.NewFormatLogWriter(os.Stderr, "[%d %t] [%L] %M"))
+	nargs := 2
+	if invFlags.Given() {
+		nargs = 1
+	}
+	if fs.NArg() != nargs {
+		log.Error("wrong args")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *loadWorkers < 1 {
+		panic(fmt.Sprintf("incorrect number of workers: %v", *loadWorkers))
+	}
+	imagePath = fs.Arg(0)
+	if err := credFlags.Setup(); err != nil {
+		panic(err.String())
+	}
+	targets, err := invFlags.Select("")
+	if err != nil {
+		panic(err.String())
+	}
+	if targets != nil {
+		if len(targets) != 1 {
+			panic(fmt.Sprintf("%v nodes are selected from the inventory, "+
+				"the target should be a single node, use -node or -role",
+				len(targets)))
+		}
+		target = targets[0]
+		return
+	}
+	if target, err = mtclib.ParseNidErr(fs.Arg(1)); err != nil {
+		log.Error("bad NID: %v", err)
+		fs.Usage()
+		log.Close()
+		os.Exit(1)
+	}
+	if err = target.ResolvePass(); err != nil {
+		panic(err.String())
+	}
+}
+
+func connect() (*mysql.MySQL, os.Error) {
+	db := target.New()
+	db.Debug = *debugMode
+	if err := target.Connect(db); err != nil {
+		return nil, fmt.Errorf("can't connect to %v: %v", target.Addr(), err)
+	}
+	return db, nil
+}
+
+// readHeader reads the chain coordinates from the leading comments of a
+// single file dump.
+func readHeader(path string) ([]*mtclib.Coordinate, os.Error) {
+	file, err := mtclib.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	chain := make([]*mtclib.Coordinate, 0)
+	rd := bufio.NewReader(file)
+	for {
+		line, err := rd.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			break
+		}
+		if strings.HasPrefix(line, "-- N") {
+			c, err := mtclib.ParseCoordinate(line[3:])
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, c)
+		}
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chain, nil
+}
+
+// execFile executes the SQL file at path on db, a "*.gz" file is decompressed.
+func execFile(db *mysql.MySQL, path string) (int, os.Error) {
+	file, err := mtclib.OpenFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return execScript(db, file)
+}
+
+func aborted(quit <-chan bool) bool {
+	select {
+	case <-quit:
+		return true
+	default:
+	}
+	return false
+}
+
+// loadWorker loads table files from jobs through db until jobs is drained,
+// every job is sent back to results. Jobs received after quit was closed are
+// skipped. Data files of a tsv or csv image are loaded in format.
+func loadWorker(db *mysql.MySQL, dir, format string, jobs <-chan *loadJob,
+	results chan<- *loadJob, quit <-chan bool) {
+
+	for job := range jobs {
+		if aborted(quit) {
+			job.err = os.NewError("aborted")
+			results <- job
+			continue
+		}
+		start := time.Nanoseconds()
+		path := filepath.Join(dir, job.file.Name)
+		if job.text {
+			job.stmts, job.err = loadText(db, path, job.file, format)
+		} else {
+			job.stmts, job.err = execFile(db, path)
+		}
+		job.elapsed = time.Nanoseconds() - start
+		results <- job
+	}
+}
+
+// loadFiles loads files of an image directory concurrently by workers.
+func loadFiles(workers []*mysql.MySQL, dir, format string,
+	files []*mtclib.DumpFile) os.Error {
+
+	text := format == mtclib.FORMAT_TSV || format == mtclib.FORMAT_CSV
+	queue := make(chan *loadJob, len(files))
+	for _, file := range files {
+		queue <- &loadJob{file: file, text: text && file.Chunk > 0}
+	}
+	close(queue)
+	results := make(chan *loadJob)
+	quit := make(chan bool)
+	for _, db := range workers {
+		go loadWorker(db, dir, format, queue, results, quit)
+	}
+	var err os.Error
+	for done := 1; done <= len(files); done++ {
+		job := <-results
+		if job.err != nil {
+			if err == nil {
+				err = fmt.Errorf("failed to load %v: %v",
+					job.file.Name, job.err)
+				close(quit)
+			}
+			continue
+		}
+		unit := "statements"
+		if job.text {
+			unit = "rows"
+		}
+		if job.file.Chunk > 0 {
+			log.Info("[%v/%v] %v.%v chunk %v/%v loaded, %v %v in %.1fs",
+				done, len(files), job.file.Db, job.file.Table,
+				job.file.Chunk, job.file.Chunks, job.stmts, unit,
+				float64(job.elapsed)/1e9)
+		} else {
+			log.Info("[%v/%v] %v.%v loaded, %v %v in %.1fs", done,
+				len(files), job.file.Db, job.file.Table, job.stmts, unit,
+				float64(job.elapsed)/1e9)
+		}
+	}
+	return err
+}
+
+// loadImage loads an image directory: database definitions first, then table
+// files, then chunks of chunked tables (or data files of a tsv or csv image),
+// files of each step are loaded concurrently by workers.
+func loadImage(workers []*mysql.MySQL, dir string,
+	manifest *mtclib.Manifest) os.Error {
+
+	format := manifest.Format
+	switch format {
+	case "":
+		// images older than the format field
+		format = mtclib.FORMAT_SQL
+	case mtclib.FORMAT_SQL, mtclib.FORMAT_TSV, mtclib.FORMAT_CSV:
+	default:
+		return fmt.Errorf("unknown data format of the image: %v", format)
+	}
+	tables := make([]*mtclib.DumpFile, 0, len(manifest.Files))
+	chunks := make([]*mtclib.DumpFile, 0, len(manifest.Files))
+	for _, file := range manifest.Files {
+		switch {
+		case file.Chunk > 0:
+			chunks = append(chunks, file)
+		case file.Table != "":
+			tables = append(tables, file)
+		default:
+			log.Info("creating database %v", file.Db)
+			_, err := execFile(workers[0], filepath.Join(dir, file.Name))
+			if err != nil {
+				return fmt.Errorf("failed to load %v: %v", file.Name, err)
+			}
+		}
+	}
+	log.Info("loading %v table(s) from %v with %v worker(s)",
+		len(tables), dir, len(workers))
+	if err := loadFiles(workers, dir, format, tables); err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	log.Info("loading %v chunk(s) from %v with %v worker(s)",
+		len(chunks), dir, len(workers))
+	return loadFiles(workers, dir, format, chunks)
+}
+
+// attach makes db a slave of the chain node at coordinate c.
+func attach(db *mysql.MySQL, c *mtclib.Coordinate) os.Error {
+	host, port, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return err
+	}
+	if _, _, err = db.Query("STOP SLAVE"); err != nil {
+		return err
+	}
+	log.Info("CHANGE MASTER TO %v:%v, %v %v", host, port, c.LogFile, c.LogPos)
+	_, _, err = db.Query("CHANGE MASTER TO MASTER_HOST='%v', MASTER_PORT=%v, "+
+		"MASTER_USER='%v', MASTER_PASSWORD='%v', "+
+		"MASTER_LOG_FILE='%v', MASTER_LOG_POS=%v",
+		db.EscapeString(host), port, db.EscapeString(*masterUser),
+		db.EscapeString(*masterPass), db.EscapeString(c.LogFile), c.LogPos)
+	if err != nil {
+		return err
+	}
+	if *startSlave {
+		log.Info("starting slave")
+		_, _, err = db.Query("START SLAVE")
+	}
+	return err
+}
+
+func run() os.Error {
+	// find out image type and the chain coordinates
+	fi, err := os.Stat(imagePath)
+	if err != nil {
+		return err
+	}
+	var manifest *mtclib.Manifest
+	var chain []*mtclib.Coordinate
+	if fi.IsDirectory() {
+		if manifest, err = mtclib.ReadManifest(imagePath); err != nil {
+			return err
+		}
+		chain = manifest.Chain
+	} else if chain, err = readHeader(imagePath); err != nil {
+		return err
+	}
+	for _, c := range chain {
+		log.Info("%v", c)
+	}
+	// validate the attaching point before loading anything
+	var point *mtclib.Coordinate
+	if *attachTo != "" {
+		names := make([]string, 0, len(chain))
+		for _, c := range chain {
+			if c.Name == *attachTo {
+				point = c
+			}
+			names = append(names, c.Name)
+		}
+		if point == nil {
+			return fmt.Errorf("no %v in the image, available nodes: %v",
+				*attachTo, strings.Join(names, ", "))
+		}
+		if point.LogFile == "" {
+			return fmt.Errorf("binlog of %v was disabled, can't attach to it",
+				point.Name)
+		}
+	}
+
+	db, err := connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if manifest != nil {
+		workers := []*mysql.MySQL{db}
+		for len(workers) < *loadWorkers {
+			worker, err := connect()
+			if err != nil {
+				return err
+			}
+			defer worker.Close()
+			workers = append(workers, worker)
+		}
+		err = loadImage(workers, imagePath, manifest)
+	} else {
+		log.Info("loading %v", imagePath)
+		var n int
+		n, err = execFile(db, imagePath)
+		log.Info("%v statements executed", n)
+	}
+	if err != nil {
+		return err
+	}
+	if point != nil {
+		return attach(db, point)
+	}
+	return nil
+}
+
+func main() {
+	parseArgs()
+	if err := run(); err != nil {
+		log.Error(err)
+		log.Info("aborting...")
+		log.Close()
+		os.Exit(1)
+	}
+	log.Info("restore completed")
+	log.Close()
+}
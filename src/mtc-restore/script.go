@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// scriptReader splits a SQL script into statements delimited by ';' outside of
+// quotes. Comment lines between statements are dropped.
+type scriptReader struct {
+	rd      *bufio.Reader
+	pending string // rest of the line after the last statement
+}
+
+func newScriptReader(rd io.Reader) *scriptReader {
+	return &scriptReader{rd: bufio.NewReader(rd)}
+}
+
+// Next returns the next statement without the trailing ';', or os.EOF.
+func (r *scriptReader) Next() (string, os.Error) {
+	stmt := new(bytes.Buffer)
+	var quote byte
+	escaped := false
+	for {
+		line := r.pending
+		r.pending = ""
+		var err os.Error
+		if line == "" {
+			line, err = r.rd.ReadString('\n')
+		}
+		if stmt.Len() == 0 {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+				if err != nil {
+					return "", err
+				}
+				continue
+			}
+		}
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case escaped:
+				escaped = false
+			case quote != 0:
+				if c == '\\' && quote != '`' {
+					escaped = true
+				} else if c == quote {
+					quote = 0
+				}
+			case c == '\'' || c == '"' || c == '`':
+				quote = c
+			case c == ';':
+				stmt.WriteString(line[:i])
+				if rest := line[i+1:]; strings.TrimSpace(rest) != "" {
+					r.pending = rest
+				}
+				return stmt.String(), nil
+			}
+		}
+		stmt.WriteString(line)
+		if err == os.EOF {
+			if strings.TrimSpace(stmt.String()) == "" {
+				return "", os.EOF
+			}
+			// last statement without delimiter
+			return stmt.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	panic("unreachable")
+}
+
+// execScript executes every statement read from rd on db, and returns the
+// number of statements executed.
+func execScript(db *mysql.MySQL, rd io.Reader) (n int, err os.Error) {
+	sr := newScriptReader(rd)
+	for {
+		stmt, err := sr.Next()
+		if err == os.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if _, _, err = db.Query(stmt); err != nil {
+			return n, fmt.Errorf("statement #%v: %v", n+1, err)
+		}
+		n++
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"mtclib"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// decompress writes the content of the compressed file at path to a
+// temporary file beside it, and returns the name of the temporary file.
+func decompress(path string) (tmp string, err os.Error) {
+	rd, err := mtclib.OpenFile(path)
+	if err != nil {
+		return
+	}
+	defer rd.Close()
+	tmp = path[:len(path)-len(".gz")] + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(file, rd)
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// loadText loads a data file of a tsv or csv image by LOAD DATA INFILE, and
+// returns the number of rows loaded. The file is read by the server, so the
+// image should be accessible to the server under the same path. A compressed
+// file is decompressed into a temporary file first.
+func loadText(db *mysql.MySQL, path string, file *mtclib.DumpFile,
+	format string) (int, os.Error) {
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	if strings.HasSuffix(path, ".gz") {
+		if path, err = decompress(path); err != nil {
+			return 0, err
+		}
+		defer os.Remove(path)
+	}
+	_, _, err = db.Query("SET UNIQUE_CHECKS=0, FOREIGN_KEY_CHECKS=0, " +
+		"SQL_MODE='NO_AUTO_VALUE_ON_ZERO'")
+	if err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf("LOAD DATA INFILE '%v' INTO TABLE %v.%v "+
+		"CHARACTER SET utf8", db.EscapeString(path),
+		mtclib.QuoteName(file.Db), mtclib.QuoteName(file.Table))
+	if format == mtclib.FORMAT_CSV {
+		// NULL is written as an unquoted NULL, quoted fields are taken
+		// verbatim since escaping is off for csv
+		query += " FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '\"' " +
+			"ESCAPED BY '' LINES TERMINATED BY '\\r\\n'"
+	}
+	_, res, err := db.Query(query)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.AffectedRows), nil
+}
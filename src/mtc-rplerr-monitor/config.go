@@ -0,0 +1,399 @@
+package main
+
+import (
+	"os"
+	"bufio"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	"mtclib"
+
+	l4g "log4go.googlecode.com/hg"
+)
+
+// Config is the config file given by -c, like:
+//
+//     [monitor]
+//     # flags by their names without '-', a bool flag alone is true
+//     t = 60
+//     lag-warning = 600
+//     notify = smtp://mail.example.com
+//     notify = critical=syslog
+//
+//     [targets]
+//     h=db2,u=monitor
+//     h=db3,u=monitor
+//
+//     [skip-policy]
+//     1062  shop.log_*  skip
+//     *                 page
+//
+// Targets are NIDs, and skip policy rules are lines of a skip policy file.
+// Empty lines and lines starting with '#' or ';' are ignored.
+type Config struct {
+	path   string
+	names  []string // of flags, in order of the file
+	values []string
+	nids   []string
+	rules  []*Rule
+}
+
+// flags not allowed in the config file, or not changed by a reload
+var (
+	cmdlineOnly = map[string]bool{"c": true}
+	staticFlags = map[string]bool{"e": true, "f": true, "b": true,
+		"pidfile": true, "http": true, "state": true}
+)
+
+// readConfig loads a config file.
+func readConfig(path string) (*Config, os.Error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	c := &Config{path: path}
+	section := ""
+	rd := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != os.EOF {
+			return nil, err
+		}
+		if perr := c.parseLine(strings.TrimSpace(line), &section); perr != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, n, perr)
+		}
+		if err == os.EOF {
+			break
+		}
+	}
+	return c, nil
+}
+
+// parseLine parses a line of a config file, *section is the current one.
+func (c *Config) parseLine(line string, section *string) os.Error {
+	switch {
+	case line == "" || line[0] == '#' || line[0] == ';':
+		return nil
+	case line[0] == '[':
+		if !strings.HasSuffix(line, "]") {
+			return fmt.Errorf("bad section: %v", line)
+		}
+		*section = strings.TrimSpace(line[1 : len(line)-1])
+		switch *section {
+		case "monitor", "targets", "skip-policy":
+			return nil
+		}
+		return fmt.Errorf("unknown section: %v", *section)
+	}
+	switch *section {
+	case "monitor":
+		name, value := line, "true"
+		if i := strings.Index(line, "="); i >= 0 {
+			name = strings.TrimSpace(line[:i])
+			value = strings.TrimSpace(line[i+1:])
+			if len(value) > 1 && (value[0] == '"' || value[0] == '\'') &&
+				value[len(value)-1] == value[0] {
+				value = value[1 : len(value)-1]
+			}
+		}
+		if fs.Lookup(name) == nil || cmdlineOnly[name] {
+			return fmt.Errorf("unknown option: %v", name)
+		}
+		c.names = append(c.names, name)
+		c.values = append(c.values, value)
+	case "targets":
+		if _, err := mtclib.ParseNidErr(line); err != nil {
+			return fmt.Errorf("bad NID: %v", err)
+		}
+		c.nids = append(c.nids, line)
+	case "skip-policy":
+		rule, err := parseRule(strings.Fields(line))
+		if err != nil {
+			return err
+		}
+		c.rules = append(c.rules, rule)
+	default:
+		return fmt.Errorf("option outside of a section: %v", line)
+	}
+	return nil
+}
+
+var (
+	// flags given on the command line, which win over the config file
+	cmdline       = make(map[string]string)
+	cmdlineNotify []string
+	// held by targets while checking, and by reloads while changing the
+	// flags and targets
+	configLock sync.RWMutex
+	// a SIGHUP asking for a reload
+	reloads = make(chan bool, 1)
+)
+
+// saveCmdline remembers the flags given on the command line.
+func saveCmdline() {
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "notify" {
+			cmdline[f.Name] = f.Value.String()
+		}
+	})
+	cmdlineNotify = append([]string(nil), notifySpecs...)
+}
+
+// flagValues returns the values of all flags, to be restored by setFlags.
+func flagValues() (map[string]string, []string) {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "notify" {
+			values[f.Name] = f.Value.String()
+		}
+	})
+	return values, append([]string(nil), notifySpecs...)
+}
+
+func setFlags(values map[string]string, notify []string) {
+	for name, value := range values {
+		fs.Set(name, value)
+	}
+	notifySpecs = append([]string(nil), notify...)
+}
+
+// loadConfig reads the config file and sets the flags by it, from their
+// defaults, then by the command line.
+func loadConfig() (*Config, os.Error) {
+	c, err := readConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	defaults := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "notify" && !cmdlineOnly[f.Name] {
+			defaults[f.Name] = f.DefValue
+		}
+	})
+	setFlags(defaults, nil)
+	for i, name := range c.names {
+		if !fs.Set(name, c.values[i]) {
+			return nil, fmt.Errorf("%v: bad value of %v: %v", c.path, name,
+				c.values[i])
+		}
+	}
+	setFlags(cmdline, notifySpecs)
+	if len(cmdlineNotify) > 0 {
+		notifySpecs = append([]string(nil), cmdlineNotify...)
+	}
+	return c, nil
+}
+
+// setup is what the flags and the config file make, checked by configure
+// before apply puts it in use.
+type setup struct {
+	servers []*mtclib.MySQLServer
+	policy  *SkipPolicy
+	routes  []*Route
+}
+
+// configure checks the flags, and the config file if any, and makes the
+// targets, the skip policy and the notifiers of them.
+func configure(c *Config) (*setup, os.Error) {
+	s := new(setup)
+	if err := credFlags.Setup(); err != nil {
+		return nil, err
+	}
+	// check inventory
+	servers, err := invFlags.Select("")
+	if err != nil {
+		return nil, err
+	}
+	nids := fs.Args()
+	if len(nids) == 0 && c != nil {
+		nids = c.nids
+	}
+	switch {
+	case servers != nil && len(nids) != 0:
+		return nil, os.NewError("NID can't be given with -inventory")
+	// check arg numbers
+	case servers == nil && len(nids) == 0:
+		return nil, os.NewError("no NID specified")
+	}
+	// check NIDs
+	for _, nid := range nids {
+		server, err := mtclib.ParseNidErr(nid)
+		if err != nil {
+			return nil, err
+		}
+		if err = server.ResolvePass(); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	seen := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		addr := fmt.Sprintf("%v:%v", server.Host, server.Port)
+		if seen[addr] {
+			return nil, fmt.Errorf("%v is given twice", addr)
+		}
+		seen[addr] = true
+	}
+	s.servers = servers
+	// load skip policy
+	switch {
+	case *policyFile != "" && c != nil && len(c.rules) > 0:
+		return nil, os.NewError("skip policy given by both -p and " +
+			"[skip-policy]")
+	case *policyFile != "":
+		if s.policy, err = readSkipPolicy(*policyFile); err != nil {
+			return nil, err
+		}
+	case c != nil && len(c.rules) > 0:
+		s.policy = &SkipPolicy{c.path, c.rules}
+	}
+	// check intervals and lag thresholds
+	if *interval <= 0 || *retryInterval <= 0 || *mailSendGap <= 0 {
+		return nil, os.NewError("-t, -r and -g should be positive")
+	}
+	if *lagWarning < 0 || *lagCritical < 0 || *stallChecks < 0 {
+		return nil, os.NewError("-lag-warning, -lag-critical and -stall " +
+			"can't be negative")
+	}
+	if *lagWarning > 0 && *lagCritical > 0 && *lagWarning >= *lagCritical {
+		return nil, os.NewError("-lag-warning should be less than " +
+			"-lag-critical")
+	}
+	// check notifiers
+	specs := notifySpecs
+	if len(specs) == 0 {
+		specs = notifyFlags{"sendmail"}
+	}
+	for _, spec := range specs {
+		route, err := parseRoute(spec)
+		if err != nil {
+			// a rejected reload doesn't leave connections behind
+			closeRoutes(s.routes)
+			return nil, err
+		}
+		if _, ok := route.notifier.(*SendmailNotifier); ok {
+			// check mailing setting
+			if _, err = os.Lstat(strings.Fields(*mailcmd)[0]); err != nil {
+				closeRoutes(s.routes)
+				return nil, err
+			}
+		}
+		route.events = make(chan *Event, 64)
+		s.routes = append(s.routes, route)
+	}
+	return s, nil
+}
+
+// setLogLevel sets the level of the general log by -l.
+func setLogLevel() {
+	switch *logLevelStr {
+	case "debug":
+		logLevel = l4g.DEBUG
+	case "warn":
+		logLevel = l4g.WARNING
+	case "error":
+		logLevel = l4g.ERROR
+	default:
+		logLevel = l4g.INFO
+	}
+	if filter := log[*logFilename]; filter != nil {
+		filter.Level = logLevel
+	}
+}
+
+// apply puts a setup in use. done is nil for the first setup, whose targets
+// and routes are started by main. On a reload, targets are kept by
+// host:port with their states, new ones and stopped ones are started, and
+// those not in the setup are stopped. It returns the number of targets
+// started.
+func apply(s *setup, done chan<- *Target) int {
+	setLogLevel()
+	policy = s.policy
+	if done == nil {
+		routes = s.routes
+	} else {
+		reroutes <- s.routes
+	}
+	kept := make(map[string]*Target, len(targets))
+	for _, t := range targets {
+		kept[t.String()] = t
+	}
+	started := 0
+	newTargets := make([]*Target, 0, len(s.servers))
+	for _, server := range s.servers {
+		addr := fmt.Sprintf("%v:%v", server.Host, server.Port)
+		t := kept[addr]
+		if t != nil {
+			// new login info is used by the next connect
+			t.server = server
+			kept[addr] = nil, false
+			if t.stopped {
+				log.Info("start monitoring %v again", t)
+				t.stopped = false
+				go t.run(done)
+				started++
+			}
+		} else {
+			t = newTarget(server)
+			if done != nil {
+				t.load()
+				log.Info("start monitoring %v", t)
+				go t.run(done)
+				started++
+			}
+		}
+		newTargets = append(newTargets, t)
+	}
+	for _, t := range kept {
+		if !t.stopped {
+			log.Info("stop monitoring %v, not configured any more", t)
+			t.stop <- true
+		}
+	}
+	targets = newTargets
+	return started
+}
+
+// replaced tells if a reload configured the address of t again, by a new
+// target holding its state, while t was stopping.
+func replaced(t *Target) bool {
+	for _, other := range targets {
+		if other != t && other.String() == t.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reads the config file again and applies it to the running
+// targets. An invalid config is rejected, the running one kept. It returns
+// the number of targets started.
+func reload(done chan<- *Target) int {
+	log.Info("reloading %v...", *configFile)
+	configLock.Lock()
+	defer configLock.Unlock()
+	values, notify := flagValues()
+	c, err := loadConfig()
+	if err == nil {
+		for name := range staticFlags {
+			if values[name] != fs.Lookup(name).Value.String() {
+				log.Warn("-%v can't be changed by a reload, restart to "+
+					"change it", name)
+				fs.Set(name, values[name])
+			}
+		}
+		var s *setup
+		if s, err = configure(c); err == nil {
+			started := apply(s, done)
+			log.Info("%v reloaded, %v target(s)", *configFile,
+				len(targets))
+			return started
+		}
+	}
+	setFlags(values, notify)
+	log.Error("reload rejected, keep running with the old config: %v", err)
+	return 0
+}
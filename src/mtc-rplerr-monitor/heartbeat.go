@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+
+	"mtclib"
+)
+
+// HEARTBEAT is raised when the heartbeat of an originating server is older
+// than a lag threshold.
+const HEARTBEAT = "HEARTBEAT"
+
+// checkHeartbeat reads the heartbeat table of the target, written by
+// mtc-heartbeat on the top masters, and returns an alert about the most
+// delayed originating server. Unlike Seconds_Behind_Master, which only tells
+// the delay behind the immediate master, this is the delay across every hop.
+func (t *Target) checkHeartbeat(execFile, execPos string) ([]*RplError,
+	os.Error) {
+
+	beats, err := mtclib.ReadHeartbeats(t.db, *heartbeatTable)
+	if err != nil {
+		return nil, err
+	}
+	t.heartbeats = beats
+	if len(beats) == 0 {
+		return []*RplError{&RplError{HEARTBEAT, "",
+			fmt.Sprintf("no heartbeat of other servers in %v",
+				*heartbeatTable), execFile, execPos, WARNING}}, nil
+	}
+	var worst *mtclib.Heartbeat
+	delays := make([]string, len(beats))
+	for i, beat := range beats {
+		delays[i] = fmt.Sprintf("server_id %v: %.1fs", beat.ServerId,
+			float64(beat.Delay)/1e6)
+		if worst == nil || beat.Delay > worst.Delay {
+			worst = beat
+		}
+	}
+	t.debug("heartbeat delays: %v", strings.Join(delays, ", "))
+	delay := worst.Delay / 1e6
+	var severity string
+	var threshold int
+	switch {
+	case *lagCritical > 0 && delay >= int64(*lagCritical):
+		severity, threshold = CRITICAL, *lagCritical
+	case *lagWarning > 0 && delay >= int64(*lagWarning):
+		severity, threshold = WARNING, *lagWarning
+	default:
+		return nil, nil
+	}
+	return []*RplError{&RplError{HEARTBEAT, "",
+		fmt.Sprintf("heartbeat of server_id %v is %v seconds old, %v at %v "+
+			"(%v)", worst.ServerId, delay, severity, threshold,
+			strings.Join(delays, ", ")),
+		execFile, execPos, severity}}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// kinds of events of an incident, which lasts from an error or alert found
+// by a check until a check finds it no more
+const (
+	EVENT_OPEN     = "open"     // found
+	EVENT_REPEAT   = "repeat"   // another error of the type, or a reminder
+	EVENT_RESOLVED = "resolved" // found no more
+)
+
+// formatDuration formats seconds like 1h2m3s.
+func formatDuration(secs int64) string {
+	str := ""
+	if secs >= 3600 {
+		str += fmt.Sprintf("%vh", secs/3600)
+	}
+	if secs >= 60 {
+		str += fmt.Sprintf("%vm", secs%3600/60)
+	}
+	return str + fmt.Sprintf("%vs", secs%60)
+}
+
+// duration returns how long the incident has been open, in seconds.
+func (es *ErrorStatus) duration() int64 {
+	return time.Seconds() - es.since
+}
+
+// clearedBy tells how an incident was resolved, as far as the monitor knows.
+func (es *ErrorStatus) clearedBy(errType string) string {
+	switch errType {
+	case SQL_ERROR:
+		if es.skippedKey == es.rplError.key() {
+			return "by skipping the error"
+		}
+		return "manually or by itself"
+	case LAG, HEARTBEAT:
+		return "by catching up"
+	case IO_STOPPED:
+		return "by starting the io_thread"
+	case SQL_STOPPED:
+		return "by starting the sql_thread"
+	case SQL_STALLED:
+		return "by the sql_thread moving again"
+	}
+	return "manually or by itself"
+}
+
+// resolve closes incidents not found by the current check, notifying of
+// those which were notified of.
+func (t *Target) resolve() {
+	for errType, es := range t.errorStatuses {
+		if es.sid == t.gsid {
+			continue
+		}
+		rplError := es.rplError
+		summary := fmt.Sprintf("%v resolved %v after %v", errType,
+			es.clearedBy(errType), formatDuration(es.duration()))
+		if es.skipped > 0 {
+			summary += fmt.Sprintf(", %v error(s) skipped", es.skipped)
+		}
+		t.info("%v, last: %v", summary, rplError)
+		if es.notified {
+			content := fmt.Sprintf("\n%v:\n", errType)
+			content += fmt.Sprintf("  - RESOLVED: %v\n", rplError)
+			content += fmt.Sprintf("  - %v.\n", summary)
+			events <- newEvent(t, EVENT_RESOLVED, errType, es, content)
+		}
+		t.errorStatuses[errType] = nil, false
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// alerts raised without an error number
+const (
+	LAG         = "LAG"         // Seconds_Behind_Master over a threshold
+	IO_STOPPED  = "IO_STOPPED"  // io_thread not running without error
+	SQL_STOPPED = "SQL_STOPPED" // sql_thread not running without error
+	SQL_STALLED = "SQL_STALLED" // sql_thread executes nothing while io_thread reads
+)
+
+// severities of alerts
+const (
+	WARNING  = "warning"
+	CRITICAL = "critical"
+)
+
+// checkLag returns alerts about the lag and the threads of the target from
+// its slave status, thread errors are left to processRplStatus.
+func (t *Target) checkLag(status map[string]string) []*RplError {
+	alerts := make([]*RplError, 0)
+	execFile := status["Relay_Master_Log_File"]
+	execPos := status["Exec_Master_Log_Pos"]
+	// a thread with an error is reported as such
+	if status["Slave_IO_Running"] == "No" &&
+		(status["Last_IO_Errno"] == "" || status["Last_IO_Errno"] == "0") {
+		alerts = append(alerts, &RplError{IO_STOPPED, "",
+			"Slave_IO_Running is No without error",
+			status["Master_Log_File"], status["Read_Master_Log_Pos"],
+			CRITICAL})
+	}
+	sqlRunning := status["Slave_SQL_Running"] == "Yes"
+	if !sqlRunning && (status["Last_SQL_Errno"] == "" ||
+		status["Last_SQL_Errno"] == "0") &&
+		(status["Last_Errno"] == "" || status["Last_Errno"] == "0") {
+		alerts = append(alerts, &RplError{SQL_STOPPED, "",
+			"Slave_SQL_Running is No without error", execFile, execPos,
+			CRITICAL})
+	}
+	// stall: the executed position stays while the read one moves
+	read := status["Master_Log_File"] + " " + status["Read_Master_Log_Pos"]
+	exec := execFile + " " + execPos
+	if sqlRunning && t.lastExec == exec && t.lastRead != read {
+		t.stallCount++
+	} else if !sqlRunning || t.lastExec != exec {
+		t.stallCount = 0
+	}
+	t.lastRead, t.lastExec = read, exec
+	if *stallChecks > 0 && t.stallCount >= *stallChecks {
+		alerts = append(alerts, &RplError{SQL_STALLED, "",
+			fmt.Sprintf("Exec_Master_Log_Pos hasn't moved for %v checks "+
+				"while Read_Master_Log_Pos advances", t.stallCount),
+			execFile, execPos, WARNING})
+	}
+	// Seconds_Behind_Master is NULL if a thread is stopped, and replaced
+	// by the delay of heartbeats if checked
+	lag, err := strconv.Atoi64(status["Seconds_Behind_Master"])
+	if err != nil || *heartbeatTable != "" {
+		return alerts
+	}
+	switch {
+	case *lagCritical > 0 && lag >= int64(*lagCritical):
+		alerts = append(alerts, &RplError{LAG, "",
+			fmt.Sprintf("Seconds_Behind_Master is %v, critical at %v",
+				lag, *lagCritical), execFile, execPos, CRITICAL})
+	case *lagWarning > 0 && lag >= int64(*lagWarning):
+		alerts = append(alerts, &RplError{LAG, "",
+			fmt.Sprintf("Seconds_Behind_Master is %v, warning at %v",
+				lag, *lagWarning), execFile, execPos, WARNING})
+	}
+	return alerts
+}
+
+// advice returns the resolve message of an alert raised by checkLag.
+func advice(errType string) string {
+	switch errType {
+	case LAG:
+		return "the slave is behind its master, it catches up by itself " +
+			"unless the load keeps it behind."
+	case IO_STOPPED:
+		return "io_thread was stopped without error, start it by " +
+			"'START SLAVE IO_THREAD' unless it was intended."
+	case SQL_STOPPED:
+		return "sql_thread was stopped without error, start it by " +
+			"'START SLAVE SQL_THREAD' unless it was intended."
+	case HEARTBEAT:
+		return "the slave is behind a top master on some hop of the chain, " +
+			"or mtc-heartbeat doesn't write heartbeats there, check every " +
+			"hop up to the server of the heartbeat."
+	case SQL_STALLED:
+		return "sql_thread is blocked, by a long transaction, a lock or a " +
+			"table without primary key under row based replication."
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"bytes"
+	"crypto/tls"
+	"exec"
+	"fmt"
+	"smtp"
+	"strings"
+	"time"
+)
+
+// formatMail formats an event as a mail from an address to the addresses.
+func formatMail(e *Event, from string, to []string) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "To: %v\n", strings.Join(to, ", "))
+	fmt.Fprintf(buf, "Subject: %v\n", e.Subject)
+	fmt.Fprintf(buf, "From: %v\n", from)
+	fmt.Fprintf(buf, "Date: %v\n", time.LocalTime().Format(time.RFC1123))
+	fmt.Fprintf(buf, "\n")
+	what := "detected"
+	if e.Kind == EVENT_RESOLVED {
+		what = "resolved"
+	}
+	fmt.Fprintf(buf, "Error %v on MySQL replication chain %v -> %v\n",
+		what, e.Master, e.Target)
+	buf.WriteString(e.Content)
+	fmt.Fprintf(buf, "\n-- \nRegards,\nmtc-rplerr-monitor on %v\n", e.Monitor)
+	fmt.Fprintf(buf, "DO NOT REPLY DIRECTLY TO THIS EMAIL")
+	return buf.Bytes()
+}
+
+// SendmailNotifier pipes events as mails to a MTA like "sendmail -t".
+type SendmailNotifier struct {
+	Command string
+	From    string
+	To      []string
+}
+
+func (n *SendmailNotifier) Notify(e *Event) os.Error {
+	tokens := strings.Fields(n.Command)
+	cmd := exec.Command(tokens[0], tokens[1:]...)
+	cmd.Stdin = bytes.NewBuffer(formatMail(e, n.From, n.To))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %v %s", tokens[0], err, out)
+	}
+	if len(out) > 0 {
+		log.Info("%v: %s", tokens[0], out)
+	}
+	return nil
+}
+
+func (n *SendmailNotifier) String() string {
+	return "sendmail"
+}
+
+// hosts of a SMTP server taken as local, authenticated without STARTTLS
+var localHosts = map[string]bool{"localhost": true, "127.0.0.1": true}
+
+// SMTPNotifier sends events as mails by a SMTP server directly. STARTTLS is
+// used whenever the server offers it, and required to authenticate unless
+// the server is on localhost (localHosts). The connection times out by
+// notifyTimeout.
+type SMTPNotifier struct {
+	Addr      string // host:port
+	User      string // "" to send without authentication
+	Pass      string
+	From      string
+	To        []string
+	TLSConfig *tls.Config // nil to verify the server by its host name
+}
+
+// parseSMTP parses smtp://[USER[:PASS]@]HOST[:PORT], the port is 25 by
+// default. A user without password takes it from MTC_SMTP_PASSWORD.
+func parseSMTP(spec string) (*SMTPNotifier, os.Error) {
+	n := &SMTPNotifier{Addr: strings.TrimRight(spec[len("smtp://"):], "/"),
+		From: *mailFrom, To: mailAddrs()}
+	if i := strings.LastIndex(n.Addr, "@"); i >= 0 {
+		n.User, n.Addr = n.Addr[:i], n.Addr[i+1:]
+		if j := strings.Index(n.User, ":"); j >= 0 {
+			n.User, n.Pass = n.User[:j], n.User[j+1:]
+		} else {
+			n.Pass = os.Getenv("MTC_SMTP_PASSWORD")
+		}
+	}
+	if n.Addr == "" {
+		return nil, os.NewError("no host of smtp notifier")
+	}
+	if strings.Index(n.Addr, ":") < 0 {
+		n.Addr += ":25"
+	}
+	if len(n.To) == 0 {
+		return nil, os.NewError("no mail address given by -m")
+	}
+	return n, nil
+}
+
+func (n *SMTPNotifier) Notify(e *Event) os.Error {
+	host := n.Addr[:strings.LastIndex(n.Addr, ":")]
+	conn, err := dial("tcp", n.Addr, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Quit()
+	secure := localHosts[host]
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := n.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: host}
+		}
+		if err = c.StartTLS(config); err != nil {
+			return err
+		}
+		secure = true
+	}
+	if n.User != "" {
+		if !secure {
+			return fmt.Errorf("%v doesn't offer STARTTLS, refuse to "+
+				"authenticate in clear", n.Addr)
+		}
+		if err = c.Auth(smtp.PlainAuth("", n.User, n.Pass, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(n.From); err != nil {
+		return err
+	}
+	for _, addr := range n.To {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(formatMail(e, n.From, n.To)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (n *SMTPNotifier) String() string {
+	if n.User != "" {
+		return "smtp://" + n.User + "@" + n.Addr
+	}
+	return "smtp://" + n.Addr
+}
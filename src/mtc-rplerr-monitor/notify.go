@@ -0,0 +1,349 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"json"
+	"net"
+	"strings"
+	"syslog"
+	"time"
+)
+
+// Event is an event of an incident of a target, sent to the notifiers
+// routed by its severity.
+type Event struct {
+	Time     string `json:"time"`
+	Monitor  string `json:"monitor"` // host running the monitor
+	Target   string `json:"target"`  // host:port
+	Master   string `json:"master"`  // host:port of the target's master
+	Kind     string `json:"kind"`    // open, repeat or resolved
+	Type     string `json:"type"`    // of the error or alert, like SQL_ERROR
+	Severity string `json:"severity"`
+	Duration int64  `json:"duration"` // of the incident so far, in seconds
+	Skipped  int    `json:"skipped"`  // errors skipped during the incident
+	Subject  string `json:"subject"`
+	Content  string `json:"content"`
+}
+
+// newEvent returns an event of the incident es of the target. Events of
+// an incident are of the highest severity it reached, so they are routed
+// alike.
+func newEvent(t *Target, kind, errType string, es *ErrorStatus,
+	content string) *Event {
+
+	subject := "error"
+	if es.severity != CRITICAL {
+		subject = "warning"
+	}
+	if kind == EVENT_RESOLVED {
+		subject += " resolved"
+	}
+	return &Event{
+		Time:     time.LocalTime().Format("2006-01-02 15:04:05"),
+		Monitor:  hostname,
+		Target:   t.String(),
+		Master:   t.master,
+		Kind:     kind,
+		Type:     errType,
+		Severity: es.severity,
+		Duration: es.duration(),
+		Skipped:  es.skipped,
+		Subject: fmt.Sprintf("MySQL replication %v on [%v]", subject,
+			t.String()),
+		Content: content}
+}
+
+// JSON returns the event as the JSON payload of hooks.
+func (e *Event) JSON() []byte {
+	data, err := json.Marshal(e)
+	if err != nil {
+		panic(fmt.Sprintf("Event.JSON()->%v", err))
+	}
+	return data
+}
+
+// Notifier sends events somewhere. String names it in logs, so it tells no
+// password nor token.
+type Notifier interface {
+	Notify(e *Event) os.Error
+	String() string
+}
+
+// closer is a notifier holding a connection, closed once its route is done.
+type closer interface {
+	Close() os.Error
+}
+
+// Route sends events of some severities to a notifier, by its own
+// goroutine so a slow notifier doesn't hold the others. Events are dropped
+// while its buffer is full.
+type Route struct {
+	severities []string // nil for all
+	notifier   Notifier
+	events     chan *Event
+}
+
+func (r *Route) accepts(severity string) bool {
+	if r.severities == nil {
+		return true
+	}
+	for _, s := range r.severities {
+		if s == severity {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Route) String() string {
+	if r.severities == nil {
+		return r.notifier.String()
+	}
+	return strings.Join(r.severities, ",") + "=" + r.notifier.String()
+}
+
+// parseRoute parses a -notify flag:
+//
+//     [SEVERITY{,SEVERITY}=]NOTIFIER
+//
+// where NOTIFIER is one of:
+//
+//     sendmail                          the -mail command to -m
+//     smtp://[USER[:PASS]@]HOST[:PORT]  a SMTP server to -m
+//     http://URL or https://URL         a webhook posted the event as JSON
+//     command:COMMAND                   a command reading the event as JSON
+//     syslog[:TAG]                      the local syslog
+func parseRoute(spec string) (*Route, os.Error) {
+	r := new(Route)
+	if i := strings.Index(spec, "="); i >= 0 && isSeverities(spec[:i]) {
+		r.severities = strings.Split(spec[:i], ",")
+		spec = spec[i+1:]
+	}
+	var err os.Error
+	switch {
+	case spec == "sendmail":
+		r.notifier = &SendmailNotifier{*mailcmd, *mailFrom, mailAddrs()}
+	case strings.HasPrefix(spec, "smtp://"):
+		r.notifier, err = parseSMTP(spec)
+	case strings.HasPrefix(spec, "http://") ||
+		strings.HasPrefix(spec, "https://"):
+		r.notifier = &WebhookNotifier{URL: spec}
+	case strings.HasPrefix(spec, "command:"):
+		command := strings.TrimSpace(spec[len("command:"):])
+		if command == "" {
+			return nil, os.NewError("no command of command notifier")
+		}
+		r.notifier = &CommandNotifier{command}
+	case spec == "syslog" || strings.HasPrefix(spec, "syslog:"):
+		tag := cmdname
+		if spec != "syslog" {
+			tag = spec[len("syslog:"):]
+		}
+		r.notifier, err = NewSyslogNotifier(tag)
+	default:
+		return nil, fmt.Errorf("unknown notifier: %v", spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func isSeverities(str string) bool {
+	for _, s := range strings.Split(str, ",") {
+		if s != WARNING && s != CRITICAL {
+			return false
+		}
+	}
+	return true
+}
+
+// mailAddrs returns the addresses of -m.
+func mailAddrs() []string {
+	addrs := make([]string, 0)
+	for _, addr := range strings.Split(*mailAddrStr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// notifyFlags are the -notify flags given, in order.
+type notifyFlags []string
+
+func (f *notifyFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *notifyFlags) Set(value string) bool {
+	*f = append(*f, value)
+	return true
+}
+
+var (
+	routes     []*Route
+	events     = make(chan *Event, 64)
+	notifyDone = make(chan bool)
+	// routes of a reload, replacing the running ones
+	reroutes = make(chan []*Route)
+)
+
+// notifier dispatches events to the routes until events is closed, then
+// waits for the routes to finish. Routes of a reload take over from the
+// next event, the old ones finish what they have got.
+func notifier() {
+	done := make(chan bool)
+	running := 0
+	for _, r := range routes {
+		go r.run(done)
+		running++
+	}
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				for _, r := range routes {
+					close(r.events)
+				}
+				for ; running > 0; running-- {
+					<-done
+				}
+				notifyDone <- true
+				return
+			}
+			log.Debug("event of %v: %v\n%v", e.Target, e.Subject, e.Content)
+			for _, r := range routes {
+				if !r.accepts(e.Severity) {
+					continue
+				}
+				// a hung notifier must not hold the targets
+				select {
+				case r.events <- e:
+				default:
+					log.Warn("%v: %v is behind, event dropped: %v", e.Target,
+						r.notifier, e.Subject)
+				}
+			}
+		case newRoutes := <-reroutes:
+			for _, r := range routes {
+				close(r.events)
+			}
+			routes = newRoutes
+			for _, r := range routes {
+				go r.run(done)
+				running++
+			}
+		case <-done:
+			running--
+		}
+	}
+	panic("unreachable")
+}
+
+// timeout of dialing, and of every read or write of the connection, of
+// notifiers, in nanoseconds
+const notifyTimeout = 30e9
+
+// dial connects to addr like net.Dial, giving up after timeout. The
+// connection times out reads and writes by timeout too.
+func dial(network, addr string, timeout int64) (net.Conn, os.Error) {
+	type result struct {
+		conn net.Conn
+		err  os.Error
+	}
+	done := make(chan *result, 1)
+	go func() {
+		conn, err := net.Dial(network, addr)
+		done <- &result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		r.conn.SetTimeout(timeout)
+		return r.conn, nil
+	case <-time.After(timeout):
+	}
+	go func() {
+		if r := <-done; r.err == nil {
+			r.conn.Close()
+		}
+	}()
+	return nil, fmt.Errorf("can't connect to %v in %v seconds", addr,
+		timeout/1e9)
+}
+
+func (r *Route) run(done chan<- bool) {
+	for e := range r.events {
+		if err := r.notifier.Notify(e); err != nil {
+			log.Warn("%v: can't notify %v: %v", e.Target, r.notifier, err)
+		}
+	}
+	r.close()
+	done <- true
+}
+
+// close closes the notifier of the route if it holds a connection.
+func (r *Route) close() {
+	if c, ok := r.notifier.(closer); ok {
+		if err := c.Close(); err != nil {
+			log.Warn("can't close %v: %v", r.notifier, err)
+		}
+	}
+}
+
+// closeRoutes closes the notifiers of routes never run.
+func closeRoutes(routes []*Route) {
+	for _, r := range routes {
+		r.close()
+	}
+}
+
+// SyslogNotifier logs events to the local syslog, resolved ones at LOG_INFO,
+// critical ones at LOG_CRIT and others at LOG_WARNING.
+type SyslogNotifier struct {
+	tag string
+	w   *syslog.Writer
+}
+
+func NewSyslogNotifier(tag string) (*SyslogNotifier, os.Error) {
+	w, err := syslog.New(syslog.LOG_WARNING, tag)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to syslog: %v", err)
+	}
+	return &SyslogNotifier{tag, w}, nil
+}
+
+func (n *SyslogNotifier) Notify(e *Event) os.Error {
+	// a message per line of the content, to be greppable by the target
+	for _, line := range strings.Split(e.Content, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		msg := fmt.Sprintf("%v: %v", e.Target, line)
+		var err os.Error
+		switch {
+		case e.Kind == EVENT_RESOLVED:
+			err = n.w.Info(msg)
+		case e.Severity == CRITICAL:
+			err = n.w.Crit(msg)
+		default:
+			err = n.w.Warning(msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *SyslogNotifier) String() string {
+	return "syslog:" + n.tag
+}
+
+func (n *SyslogNotifier) Close() os.Error {
+	return n.w.Close()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"bufio"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// actions of skip policy rules
+const (
+	ACT_SKIP   = "skip"   // skip the error, up to a limit per hour if given
+	ACT_PAGE   = "page"   // leave the replication stopped and mail
+	ACT_IGNORE = "ignore" // leave the replication stopped without any alert
+)
+
+// neverSkip are errors never skipped automatically, whatever the policy or
+// -s says, as skipping them silently diverges the slave.
+var neverSkip = map[string]string{
+	"1146": "table doesn't exist"}
+
+// Rule is a line of a skip policy file:
+//
+//     ERRNO [DB.TABLE] ACTION [LIMIT]
+//
+// ERRNO is an error number or "*", DB.TABLE a pattern (see path.Match) of
+// the table of the error, "*" if not given, ACTION one of skip, page or
+// ignore, and LIMIT the maximum number of skips per hour of a skip rule.
+type Rule struct {
+	errno  string
+	object string
+	action string
+	limit  int // 0 for unlimited
+}
+
+func (r *Rule) String() string {
+	str := fmt.Sprintf("%v %v %v", r.errno, r.object, r.action)
+	if r.limit > 0 {
+		str += fmt.Sprintf(" %v", r.limit)
+	}
+	return str
+}
+
+// SkipPolicy decides what to do with SQL errors by the first matching rule,
+// errors matching no rule are skipped if -s is set.
+type SkipPolicy struct {
+	path  string
+	rules []*Rule
+}
+
+// readSkipPolicy loads a skip policy file, empty lines and lines starting
+// with '#' are ignored.
+func readSkipPolicy(path string) (*SkipPolicy, os.Error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	policy := &SkipPolicy{path: path}
+	rd := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != os.EOF {
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			rule, perr := parseRule(fields)
+			if perr != nil {
+				return nil, fmt.Errorf("%v:%v: %v", path, n, perr)
+			}
+			policy.rules = append(policy.rules, rule)
+		}
+		if err == os.EOF {
+			break
+		}
+	}
+	return policy, nil
+}
+
+func parseRule(fields []string) (*Rule, os.Error) {
+	rule := &Rule{errno: fields[0], object: "*"}
+	if rule.errno != "*" {
+		if _, err := strconv.Atoi(rule.errno); err != nil {
+			return nil, fmt.Errorf("bad error number: %v", rule.errno)
+		}
+	}
+	fields = fields[1:]
+	if len(fields) > 0 && !isAction(fields[0]) {
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("bad table pattern: %v", fields[0])
+		}
+		rule.object = fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return nil, os.NewError("no action, should be skip, page or ignore")
+	}
+	rule.action = fields[0]
+	if !isAction(rule.action) {
+		return nil, fmt.Errorf("unknown action: %v", rule.action)
+	}
+	switch {
+	case len(fields) == 2 && rule.action == ACT_SKIP:
+		limit, err := strconv.Atoi(fields[1])
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("bad limit of skips per hour: %v",
+				fields[1])
+		}
+		rule.limit = limit
+	case len(fields) > 1:
+		return nil, fmt.Errorf("trailing fields: %v",
+			strings.Join(fields[1:], " "))
+	}
+	if why, ok := neverSkip[rule.errno]; ok && rule.action == ACT_SKIP {
+		return nil, fmt.Errorf("#%v (%v) can't be skipped automatically",
+			rule.errno, why)
+	}
+	return rule, nil
+}
+
+func isAction(str string) bool {
+	return str == ACT_SKIP || str == ACT_PAGE || str == ACT_IGNORE
+}
+
+// match returns the first rule matching an error, or nil.
+func (p *SkipPolicy) match(errno, object string) *Rule {
+	for _, rule := range p.rules {
+		if rule.errno != "*" && rule.errno != errno {
+			continue
+		}
+		if ok, _ := path.Match(rule.object, object); ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// errorObject returns the table of a SQL error message as "db.table", or
+// "db." if only the default database is known, or "".
+func errorObject(msg string) string {
+	// row based: "Could not execute Write_rows event on table db.t; ..."
+	if i := strings.Index(msg, " on table "); i >= 0 {
+		object := msg[i+len(" on table "):]
+		if end := strings.IndexAny(object, "; "); end >= 0 {
+			object = object[:end]
+		}
+		return object
+	}
+	// statement based: "... Default database: 'db'. Query: '...'"
+	const prefix = "Default database: '"
+	if i := strings.Index(msg, prefix); i >= 0 {
+		db := msg[i+len(prefix):]
+		if end := strings.Index(db, "'"); end >= 0 {
+			return db[:end] + "."
+		}
+	}
+	return ""
+}
+
+// decide returns the action on a SQL error of the target, the rule deciding
+// it if any, and the reason if the error is not skipped.
+func (t *Target) decide(rplError *RplError) (action string, rule *Rule,
+	msg string) {
+
+	if why, ok := neverSkip[rplError.errno]; ok {
+		return ACT_PAGE, nil, fmt.Sprintf("#%v (%v) is never skipped "+
+			"automatically, manual override is required.", rplError.errno,
+			why)
+	}
+	if policy != nil {
+		rule = policy.match(rplError.errno, errorObject(rplError.error))
+	}
+	if rule == nil {
+		if *skip {
+			return ACT_SKIP, nil, ""
+		}
+		return ACT_PAGE, nil, ""
+	}
+	switch rule.action {
+	case ACT_IGNORE:
+		return ACT_IGNORE, rule, fmt.Sprintf("ignored by skip policy "+
+			"rule '%v', the slave stays stopped without alert.", rule)
+	case ACT_PAGE:
+		return ACT_PAGE, rule, fmt.Sprintf("stopped by skip policy rule "+
+			"'%v', manual override is required.", rule)
+	}
+	if n := t.recentSkips(rule); rule.limit > 0 && n >= rule.limit {
+		return ACT_PAGE, rule, fmt.Sprintf("%v errors were skipped in the "+
+			"last hour by skip policy rule '%v', reaching its limit, "+
+			"manual override is required.", n, rule)
+	}
+	return ACT_SKIP, rule, ""
+}
+
+// recentSkips returns how many errors the rule skipped on the target in the
+// last hour.
+func (t *Target) recentSkips(rule *Rule) int {
+	key := rule.String()
+	since := time.Seconds() - 3600
+	skips := t.skips[key]
+	for len(skips) > 0 && skips[0] < since {
+		skips = skips[1:]
+	}
+	t.skips[key] = skips
+	return len(skips)
+}
+
+// skipped records a skip of an error by the rule, nil if skipped by -s.
+func (t *Target) skipped(rule *Rule) {
+	t.skipCount++
+	if rule != nil {
+		key := rule.String()
+		t.skips[key] = append(t.skips[key], time.Seconds())
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"io/ioutil"
+	"json"
+	"time"
+)
+
+// TargetState is the error state of a target kept in the state file, so a
+// restarted monitor goes on with known errors instead of alerting them anew.
+type TargetState struct {
+	Gsid      uint64             `json:"gsid"`
+	SkipCount int                `json:"skip_count"` // errors skipped
+	Skips     map[string][]int64 `json:"skips"`      // by rule, see Target.skips
+	Errors    []*ErrorState      `json:"errors"`
+}
+
+// ErrorState is an ErrorStatus in the state file.
+type ErrorState struct {
+	Type        string `json:"type"`
+	Errno       string `json:"errno"`
+	Error       string `json:"error"`
+	LogFile     string `json:"log_file"`
+	Pos         string `json:"pos"`
+	Severity    string `json:"severity"`
+	Sid         uint64 `json:"sid"`
+	RepeatCount int    `json:"repeat_count"`
+	Msg         string `json:"msg"`
+	Action      string `json:"action"`
+	Rule        string `json:"rule"` // "" if not decided by a rule
+	Since       int64  `json:"since"`
+	MaxSeverity string `json:"max_severity"` // of the incident
+	Skipped     int    `json:"skipped"`
+	SkippedKey  string `json:"skipped_key"`
+	Notified    bool   `json:"notified"`
+}
+
+// targetState is a snapshot of a target for the saver, nil to drop it from
+// the state file.
+type targetState struct {
+	addr  string
+	state *TargetState
+}
+
+var (
+	states    = make(chan *targetState, 64)
+	saverDone = make(chan bool)
+	// addresses of targets added by a reload, and their saved states
+	restores = make(chan string)
+	restored = make(chan *TargetState)
+)
+
+// state returns a snapshot of the error state of the target.
+func (t *Target) state() *TargetState {
+	s := &TargetState{
+		Gsid:      t.gsid,
+		SkipCount: t.skipCount,
+		Skips:     make(map[string][]int64, len(t.skips))}
+	for key, skips := range t.skips {
+		if len(skips) > 0 {
+			s.Skips[key] = append([]int64(nil), skips...)
+		}
+	}
+	for errType, errorStatus := range t.errorStatuses {
+		rplError := errorStatus.rplError
+		e := &ErrorState{
+			Type:        errType,
+			Errno:       rplError.errno,
+			Error:       rplError.error,
+			LogFile:     rplError.logFile,
+			Pos:         rplError.pos,
+			Severity:    rplError.severity,
+			Sid:         errorStatus.sid,
+			RepeatCount: errorStatus.repeatCount,
+			Msg:         errorStatus.msg,
+			Action:      errorStatus.action,
+			Since:       errorStatus.since,
+			MaxSeverity: errorStatus.severity,
+			Skipped:     errorStatus.skipped,
+			SkippedKey:  errorStatus.skippedKey,
+			Notified:    errorStatus.notified}
+		if errorStatus.rule != nil {
+			e.Rule = errorStatus.rule.String()
+		}
+		s.Errors = append(s.Errors, e)
+	}
+	return s
+}
+
+// restore sets the error state of the target from the state file. An error
+// found again at the same position on the next check is a continuation of
+// the restored incident, an incident not found is resolved. A rule no longer
+// in the skip policy is dropped.
+func (t *Target) restore(s *TargetState) {
+	t.gsid = s.Gsid
+	t.skipCount = s.SkipCount
+	for key, skips := range s.Skips {
+		t.skips[key] = skips
+	}
+	for _, e := range s.Errors {
+		errorStatus := &ErrorStatus{
+			sid: e.Sid,
+			rplError: &RplError{e.Type, e.Errno, e.Error, e.LogFile, e.Pos,
+				e.Severity},
+			repeatCount: e.RepeatCount,
+			msg:         e.Msg,
+			action:      e.Action,
+			since:       e.Since,
+			severity:    e.MaxSeverity,
+			skipped:     e.Skipped,
+			skippedKey:  e.SkippedKey,
+			notified:    e.Notified}
+		if errorStatus.since == 0 {
+			// saved before incidents were kept
+			errorStatus.since = time.Seconds()
+			errorStatus.severity = e.Severity
+		}
+		if e.Rule != "" && policy != nil {
+			for _, rule := range policy.rules {
+				if rule.String() == e.Rule {
+					errorStatus.rule = rule
+				}
+			}
+		}
+		t.errorStatuses[e.Type] = errorStatus
+	}
+}
+
+// save sends a snapshot of the target to the saver if a state file is given.
+func (t *Target) save() {
+	if *stateFilename != "" {
+		states <- &targetState{t.String(), t.state()}
+	}
+}
+
+// drop removes a stopped target from the state file. Its state is kept by
+// the saver in case a reload monitors it again.
+func (t *Target) drop() {
+	if *stateFilename != "" {
+		states <- &targetState{t.String(), nil}
+	}
+}
+
+// load restores a target added by a reload from the saver, if a state file
+// is given.
+func (t *Target) load() {
+	if *stateFilename == "" {
+		return
+	}
+	restores <- t.String()
+	if s := <-restored; s != nil {
+		t.restore(s)
+		t.info("state restored: gsid %v, %v error(s), %v skipped",
+			s.Gsid, len(s.Errors), s.SkipCount)
+	}
+}
+
+// readState loads the state file, an absent file is an empty state.
+func readState(path string) (map[string]*TargetState, os.Error) {
+	all := make(map[string]*TargetState)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if _, serr := os.Stat(path); serr != nil {
+			return all, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("bad state file %v: %v", path, err)
+	}
+	return all, nil
+}
+
+// restoreState restores targets from the state file, if given. It returns
+// the restored states, and the others, of targets not monitored.
+func restoreState() (all, spare map[string]*TargetState) {
+	all = make(map[string]*TargetState)
+	spare = make(map[string]*TargetState)
+	if *stateFilename == "" {
+		return
+	}
+	loaded, err := readState(*stateFilename)
+	if err != nil {
+		// a broken state file only costs repeated alerts
+		log.Warn("%v, starting with an empty state", err)
+		return
+	}
+	for _, t := range targets {
+		addr := t.String()
+		if s := loaded[addr]; s != nil {
+			t.restore(s)
+			all[addr] = s
+			loaded[addr] = nil, false
+			t.info("state restored: gsid %v, %v error(s), %v skipped",
+				s.Gsid, len(s.Errors), s.SkipCount)
+		}
+	}
+	return all, loaded
+}
+
+// saver writes snapshots of targets to the state file until states is
+// closed, and answers restores of targets added by reloads. all holds the
+// states of the monitored targets, spare those of targets not monitored
+// any more, which are dropped from the file.
+func saver(all, spare map[string]*TargetState) {
+	for {
+		select {
+		case s, ok := <-states:
+			if !ok {
+				saverDone <- true
+				return
+			}
+			if s.state != nil {
+				all[s.addr] = s.state
+			} else if all[s.addr] != nil {
+				spare[s.addr] = all[s.addr]
+				all[s.addr] = nil, false
+			} else {
+				continue
+			}
+			if err := writeState(*stateFilename, all); err != nil {
+				log.Warn("can't save state to %v: %v", *stateFilename, err)
+			}
+		case addr := <-restores:
+			s := all[addr]
+			if s == nil {
+				s = spare[addr]
+				spare[addr] = nil, false
+			}
+			restored <- s
+		}
+	}
+	panic("unreachable")
+}
+
+// writeState replaces the state file by a temporary file renamed over it, so
+// a crash never leaves it half written.
+func writeState(path string, all map[string]*TargetState) os.Error {
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
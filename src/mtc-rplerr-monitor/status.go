@@ -0,0 +1,251 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"http"
+	"io"
+	"json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TargetStatus is what the HTTP endpoint tells of a target, published by the
+// target after every check.
+type TargetStatus struct {
+	Target             string             `json:"target"`
+	Master             string             `json:"master"`
+	Checked            string             `json:"checked"` // time of the last check
+	Checks             int                `json:"checks"`
+	Connected          bool               `json:"connected"`
+	Error              string             `json:"error"` // of the last check
+	ConnectionFailures int                `json:"connection_failures"`
+	SkipCount          int                `json:"skip_count"`
+	RecentSkips        map[string]int     `json:"recent_skips"` // in the last hour by rule
+	SlaveStatus        map[string]string  `json:"slave_status"` // of the last check
+	Heartbeats         []*HeartbeatStatus `json:"heartbeats"`
+	Incidents          []*IncidentStatus  `json:"incidents"`
+}
+
+// HeartbeatStatus is the delay of a target behind an originating server.
+type HeartbeatStatus struct {
+	ServerId int64   `json:"server_id"`
+	Delay    float64 `json:"delay"` // in seconds
+}
+
+// IncidentStatus is an open incident of a target.
+type IncidentStatus struct {
+	Type        string `json:"type"`
+	Severity    string `json:"severity"`
+	Since       string `json:"since"`
+	Duration    int64  `json:"duration"` // in seconds
+	RepeatCount int    `json:"repeat_count"`
+	Skipped     int    `json:"skipped"`
+	Action      string `json:"action"` // of a SQL error
+	Error       string `json:"error"`  // the last one
+	Msg         string `json:"msg"`
+}
+
+var (
+	statusLock sync.Mutex
+	published  = make(map[string]*TargetStatus)
+)
+
+// publish publishes the status of the target if -http is given. checkErr is
+// the error of the check if any.
+func (t *Target) publish(checkErr string) {
+	if *httpAddr == "" {
+		return
+	}
+	t.checks++
+	s := &TargetStatus{
+		Target:             t.String(),
+		Master:             t.master,
+		Checked:            time.LocalTime().Format("2006-01-02 15:04:05"),
+		Checks:             t.checks,
+		Connected:          t.db != nil && t.db.IsConnected(),
+		Error:              checkErr,
+		ConnectionFailures: t.connFailures,
+		SkipCount:          t.skipCount,
+		RecentSkips:        make(map[string]int),
+		SlaveStatus:        t.slaveStatus}
+	since := time.Seconds() - 3600
+	for key, skips := range t.skips {
+		for _, skip := range skips {
+			if skip >= since {
+				s.RecentSkips[key]++
+			}
+		}
+	}
+	for _, beat := range t.heartbeats {
+		s.Heartbeats = append(s.Heartbeats,
+			&HeartbeatStatus{beat.ServerId, float64(beat.Delay) / 1e6})
+	}
+	errTypes := make([]string, 0, len(t.errorStatuses))
+	for errType := range t.errorStatuses {
+		errTypes = append(errTypes, errType)
+	}
+	sort.Strings(errTypes)
+	for _, errType := range errTypes {
+		es := t.errorStatuses[errType]
+		opened := time.SecondsToLocalTime(es.since)
+		s.Incidents = append(s.Incidents, &IncidentStatus{
+			Type:        errType,
+			Severity:    es.severity,
+			Since:       opened.Format("2006-01-02 15:04:05"),
+			Duration:    es.duration(),
+			RepeatCount: es.repeatCount,
+			Skipped:     es.skipped,
+			Action:      es.action,
+			Error:       es.rplError.String(),
+			Msg:         es.msg})
+	}
+	statusLock.Lock()
+	published[s.Target] = s
+	statusLock.Unlock()
+}
+
+// statuses returns the published statuses in the order of targets, a
+// target not checked yet is left out.
+func statuses() []*TargetStatus {
+	// targets are changed by reloads
+	configLock.RLock()
+	defer configLock.RUnlock()
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	all := make([]*TargetStatus, 0, len(targets))
+	for _, t := range targets {
+		if s := published[t.String()]; s != nil {
+			all = append(all, s)
+		}
+	}
+	return all
+}
+
+// serveHTTP serves /healthz, /status and /metrics on addr, in background.
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.MarshalIndent(statuses(), "", "  ")
+		if err != nil {
+			http.Error(w, err.String(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, statuses())
+	})
+	go func() {
+		log.Info("serving http on %v", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Error("can't serve http on %v: %v", addr, err)
+		}
+	}()
+}
+
+// metric is a metric family of the Prometheus text format.
+type metric struct {
+	name    string
+	kind    string // gauge or counter
+	help    string
+	samples []string
+}
+
+func (m *metric) add(value interface{}, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", labels[i],
+			labelValue(labels[i+1])))
+	}
+	m.samples = append(m.samples, fmt.Sprintf("%v{%v} %v", m.name,
+		strings.Join(pairs, ","), value))
+}
+
+// labelValue escapes a label value of the Prometheus text format.
+func labelValue(str string) string {
+	str = strings.Replace(str, "\\", "\\\\", -1)
+	str = strings.Replace(str, "\"", "\\\"", -1)
+	return strings.Replace(str, "\n", "\\n", -1)
+}
+
+func running(str string) int {
+	if str == "Yes" {
+		return 1
+	}
+	return 0
+}
+
+// writeMetrics writes metrics of the targets in the Prometheus text format.
+func writeMetrics(w io.Writer, all []*TargetStatus) os.Error {
+	up := &metric{name: "mtc_rplerr_up", kind: "gauge",
+		help: "Whether the last check of the target succeeded."}
+	checks := &metric{name: "mtc_rplerr_checks_total", kind: "counter",
+		help: "Checks of the target."}
+	lag := &metric{name: "mtc_rplerr_seconds_behind_master", kind: "gauge",
+		help: "Seconds_Behind_Master of the target, absent if NULL."}
+	heartbeat := &metric{name: "mtc_rplerr_heartbeat_delay_seconds",
+		kind: "gauge",
+		help: "Delay of the target behind the heartbeat of a server."}
+	ioRunning := &metric{name: "mtc_rplerr_io_thread_running", kind: "gauge",
+		help: "Whether Slave_IO_Running is Yes."}
+	sqlRunning := &metric{name: "mtc_rplerr_sql_thread_running",
+		kind: "gauge", help: "Whether Slave_SQL_Running is Yes."}
+	skipped := &metric{name: "mtc_rplerr_errors_skipped_total",
+		kind: "counter", help: "SQL errors skipped on the target."}
+	failures := &metric{name: "mtc_rplerr_connection_failures_total",
+		kind: "counter",
+		help: "Failures to connect to the target, or lost connections."}
+	incidents := &metric{name: "mtc_rplerr_incident_open", kind: "gauge",
+		help: "Open incidents of the target by type and severity."}
+	for _, s := range all {
+		t := s.Target
+		if s.Error == "" {
+			up.add(1, "target", t)
+		} else {
+			up.add(0, "target", t)
+		}
+		checks.add(s.Checks, "target", t)
+		if v := s.SlaveStatus["Seconds_Behind_Master"]; v != "" {
+			lag.add(v, "target", t)
+		}
+		for _, beat := range s.Heartbeats {
+			heartbeat.add(fmt.Sprintf("%.3f", beat.Delay), "target", t,
+				"server_id", fmt.Sprint(beat.ServerId))
+		}
+		if s.SlaveStatus != nil {
+			ioRunning.add(running(s.SlaveStatus["Slave_IO_Running"]),
+				"target", t)
+			sqlRunning.add(running(s.SlaveStatus["Slave_SQL_Running"]),
+				"target", t)
+		}
+		skipped.add(s.SkipCount, "target", t)
+		failures.add(s.ConnectionFailures, "target", t)
+		for _, incident := range s.Incidents {
+			incidents.add(1, "target", t, "type", incident.Type,
+				"severity", incident.Severity)
+		}
+	}
+	for _, m := range []*metric{up, checks, lag, heartbeat, ioRunning,
+		sqlRunning, skipped, failures, incidents} {
+		_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", m.name,
+			m.help, m.name, m.kind)
+		if err != nil {
+			return err
+		}
+		for _, sample := range m.samples {
+			if _, err = fmt.Fprintln(w, sample); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
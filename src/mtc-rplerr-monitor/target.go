@@ -0,0 +1,408 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+
+	"mtclib"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+const (
+	IO_ERROR  = "IO_ERROR"
+	SQL_ERROR = "SQL_ERROR"
+)
+
+// Target is a monitored replica, checked by its own goroutine. Its state is
+// only touched by that goroutine, and its login info by reloads.
+type Target struct {
+	server        *mtclib.MySQLServer
+	db            *mysql.MySQL
+	master        string // host:port of the master
+	gsid          uint64 // global sequence id
+	errorStatuses map[string]*ErrorStatus
+	// positions of the last check, "file pos", to detect a stall
+	lastRead   string
+	lastExec   string
+	stallCount int // consecutive checks with a stalled sql_thread
+	// heartbeats of the last check, and the last error reading them
+	heartbeats   []*mtclib.Heartbeat
+	heartbeatErr string
+	// times of skips in the last hour, by skip policy rule
+	skips     map[string][]int64
+	skipCount int // errors skipped, kept across restarts by the state file
+	// published by the HTTP endpoint
+	slaveStatus  map[string]string // of the last check
+	checks       int
+	connFailures int       // failed connects and lost connections
+	stop         chan bool // by a reload not configuring it any more
+	stopped      bool      // set by main once run returns
+}
+
+func newTarget(server *mtclib.MySQLServer) *Target {
+	return &Target{
+		server:        server,
+		errorStatuses: make(map[string]*ErrorStatus, 2),
+		skips:         make(map[string][]int64),
+		stop:          make(chan bool, 1)}
+}
+
+func (t *Target) String() string {
+	return fmt.Sprintf("%v:%v", t.server.Host, t.server.Port)
+}
+
+// logging of the target, messages are prefixed by its address
+func (t *Target) debug(format string, args ...interface{}) {
+	log.Debug("%v: %v", t, fmt.Sprintf(format, args...))
+}
+
+func (t *Target) info(format string, args ...interface{}) {
+	log.Info("%v: %v", t, fmt.Sprintf(format, args...))
+}
+
+func (t *Target) warn(format string, args ...interface{}) {
+	log.Warn("%v: %v", t, fmt.Sprintf(format, args...))
+}
+
+func (t *Target) error(format string, args ...interface{}) {
+	log.Error("%v: %v", t, fmt.Sprintf(format, args...))
+}
+
+type RplError struct {
+	errType  string
+	errno    string // "" for alerts of checkLag
+	error    string
+	logFile  string
+	pos      string
+	severity string
+}
+
+func (err *RplError) String() string {
+	if err.errno == "" {
+		return fmt.Sprintf("[%v %v] %v", err.logFile, err.pos, err.error)
+	}
+	return fmt.Sprintf("[%v %v] #%v: %v",
+		err.logFile, err.pos, err.errno, err.error)
+}
+
+// key identifies an error across checks, an error of another key is a new
+// one. Lag is identified by its severity, a stopped thread by its type only.
+func (err *RplError) key() string {
+	switch err.errType {
+	case LAG, HEARTBEAT:
+		return err.severity
+	case IO_STOPPED, SQL_STOPPED:
+		return ""
+	}
+	return err.logFile + " " + err.pos
+}
+
+type ErrorStatus struct {
+	sid         uint64 // sequence id
+	rplError    *RplError
+	repeatCount int
+	msg         string // problem resolve message
+	action      string // of a SQL error, decided when it is found
+	rule        *Rule  // the skip policy rule deciding action, if any
+	// the incident, from the first check finding an error of the type
+	since      int64  // time it was opened, in seconds
+	severity   string // the highest of the incident
+	skipped    int    // errors skipped during the incident
+	skippedKey string // key of the last error skipped
+	notified   bool   // of the incident opened
+}
+
+func isMySQLError(err os.Error) bool {
+	if _, ok := err.(*mysql.Error); ok {
+		return true
+	}
+	return false
+}
+
+// processRplStatus checks the slave status once. checkErr is the error
+// failing the check if any, like a target found not to be a slave.
+func (t *Target) processRplStatus() (slave bool, reconnect bool,
+	checkErr string) {
+
+	db := t.db
+	slave, reconnect = true, false
+	status, err := mtclib.SlaveStatus(db)
+	if err != nil {
+		t.warn("'SHOW SLAVE STATUS' returned with error: %v", err)
+		reconnect = !isMySQLError(err)
+		checkErr = fmt.Sprintf("SHOW SLAVE STATUS: %v", err)
+		return
+	}
+	if status == nil {
+		t.error("can't find slave info on this instance")
+		slave, reconnect = false, false
+		checkErr = "not a slave"
+		return
+	}
+	t.slaveStatus = status
+	t.gsid += 1
+	t.debug("current gsid: %v", t.gsid)
+	host, port := mtclib.MasterOf(t.server, status)
+	t.master = fmt.Sprintf("%v:%v", host, port)
+	var rplErrors []*RplError
+	// check IO_Error
+	errNo, ok_io := status["Last_IO_Errno"]
+	if ok_io && errNo != "0" {
+		rplError := &RplError{IO_ERROR, errNo, status["Last_IO_Error"],
+			status["Master_Log_File"], status["Read_Master_Log_Pos"], CRITICAL}
+		rplErrors = append(rplErrors, rplError)
+		t.debug("add IO error: %v", rplError)
+	}
+	// check SQL_Error
+	errNo, ok_sql := status["Last_SQL_Errno"]
+	if ok_sql && errNo != "0" {
+		rplError := &RplError{SQL_ERROR, errNo, status["Last_SQL_Error"],
+			status["Relay_Master_Log_File"], status["Exec_Master_Log_Pos"],
+			CRITICAL}
+		rplErrors = append(rplErrors, rplError)
+		t.debug("add SQL error: %v", rplError)
+	}
+	// backward compatibility: check Last_error
+	errNo, ok_b := status["Last_Errno"]
+	if !ok_io && !ok_sql && ok_b && errNo != "0" {
+		rplError := &RplError{SQL_ERROR, errNo, status["Last_Error"],
+			status["Relay_Master_Log_File"], status["Exec_Master_Log_Pos"],
+			CRITICAL}
+		rplErrors = append(rplErrors, rplError)
+		t.debug("add error: %v", rplError)
+	}
+	// check lag and threads stopped without error
+	for _, rplError := range t.checkLag(status) {
+		rplErrors = append(rplErrors, rplError)
+		t.debug("add %v alert: %v", rplError.errType, rplError)
+	}
+	// check the delay behind the top masters
+	if *heartbeatTable != "" {
+		alerts, err := t.checkHeartbeat(status["Relay_Master_Log_File"],
+			status["Exec_Master_Log_Pos"])
+		if err != nil {
+			// warned once until it changes, as the table may be missing
+			if err.String() != t.heartbeatErr {
+				t.warn("can't check heartbeat: %v", err)
+			}
+			t.heartbeatErr = err.String()
+			t.heartbeats = nil
+			if !isMySQLError(err) {
+				reconnect = true
+				checkErr = fmt.Sprintf("can't check heartbeat: %v", err)
+				return
+			}
+		} else if t.heartbeatErr != "" {
+			t.info("heartbeat checked again")
+			t.heartbeatErr = ""
+		}
+		for _, rplError := range alerts {
+			rplErrors = append(rplErrors, rplError)
+			t.debug("add %v alert: %v", rplError.errType, rplError)
+		}
+	}
+	// check freshness
+	for _, rplError := range rplErrors {
+		if prevErr := t.errorStatuses[rplError.errType]; prevErr == nil {
+			errorStatus := &ErrorStatus{sid: t.gsid, rplError: rplError,
+				since: time.Seconds(), severity: rplError.severity}
+			t.errorStatuses[rplError.errType] = errorStatus
+		} else {
+			if (t.gsid-prevErr.sid) > 1 || // fell too far behind
+				rplError.key() != prevErr.rplError.key() {
+				prevErr.repeatCount = 0
+				prevErr.msg = ""
+			} else {
+				prevErr.repeatCount += 1
+			}
+			// the same error, with up-to-date details like the lag
+			prevErr.rplError = rplError
+			prevErr.sid = t.gsid // set sid up-to-date
+			if rplError.severity == CRITICAL {
+				prevErr.severity = CRITICAL
+			}
+		}
+	}
+	// errors not found any more are resolved
+	t.resolve()
+	// deal with the situation
+	for errorType, errorStatus := range t.errorStatuses {
+		rplError := errorStatus.rplError
+		t.debug("Processing [%v %v] %v",
+			rplError.logFile, rplError.pos, errorType)
+		if msg := advice(errorType); msg != "" {
+			if errorStatus.repeatCount == 0 {
+				t.warn("%v: %v", errorType, rplError)
+			}
+			errorStatus.msg = msg
+			continue
+		}
+		if errorStatus.repeatCount == 0 {
+			sqlog.Info("%v %v", t, rplError)
+			if errorType == SQL_ERROR {
+				t.info("found rpl error: [%v %v] ErrNo:#%v",
+					rplError.logFile, rplError.pos, rplError.errno)
+				errorStatus.action, errorStatus.rule, errorStatus.msg =
+					t.decide(rplError)
+				if errorStatus.msg != "" {
+					t.warn("not skipping: %v", errorStatus.msg)
+				}
+			} else if errorType == IO_ERROR {
+				t.warn("IO_ERROR can only be resolved manually or by itself.")
+				errorStatus.msg = fmt.Sprintf("IO_ERROR can only be resolved "+
+					"manually or by itself. This error was logged to %v on %v.",
+					*sqlogFilename, hostname)
+				continue
+			} else {
+				continue
+			}
+		}
+		if errorStatus.action == ACT_SKIP {
+			if errorType == SQL_ERROR {
+				t.info("trying to skip rpl error...")
+				_, _, err = db.Query(
+					"SET GLOBAL SQL_SLAVE_SKIP_COUNTER = 1")
+				if err != nil {
+					msg := fmt.Sprintf("trying to skip error but: %v", err)
+					t.warn(msg)
+					errorStatus.msg = msg
+					reconnect = reconnect || !isMySQLError(err)
+					continue
+				}
+				_, _, err = db.Query("START SLAVE SQL_THREAD")
+				if err != nil {
+					msg := fmt.Sprintf("trying to restart slave sql_thread "+
+						"but: %v, will retry later", err)
+					t.warn(msg)
+					errorStatus.msg = msg
+					reconnect = reconnect || !isMySQLError(err)
+					continue
+				}
+				t.skipped(errorStatus.rule)
+				errorStatus.skipped++
+				errorStatus.skippedKey = rplError.key()
+			}
+		}
+	}
+	// notify of opened incidents, and of repeated ones every -g checks
+	for errorType, errorStatus := range t.errorStatuses {
+		rplError := errorStatus.rplError
+		if errorStatus.repeatCount%*mailSendGap != 0 ||
+			errorStatus.action == ACT_IGNORE {
+			continue
+		}
+		t.debug("formatting mail for %v [%v %v]",
+			errorType, rplError.logFile, rplError.pos)
+		kind := EVENT_OPEN
+		if errorStatus.notified {
+			kind = EVENT_REPEAT
+		}
+		content := fmt.Sprintf("\n%v:\n", errorType)
+		content += fmt.Sprintf("  - WARNING: %v\n", rplError.String())
+		if errorStatus.msg != "" {
+			content += fmt.Sprintf("  - %v\n", errorStatus.msg)
+		} else {
+			if errorStatus.action == ACT_SKIP {
+				content += fmt.Sprintf("  - Note: this error was jumped and "+
+					"logged to %v on %v.\n", *sqlogFilename, hostname)
+			} else {
+				content += fmt.Sprintf("  - WARNING: this error was logged to "+
+					"%v on %v, but still blocking the replication, manual "+
+					"override is required.\n", *sqlogFilename, hostname)
+			}
+		}
+		if kind == EVENT_REPEAT {
+			content += fmt.Sprintf("  - Open for %v",
+				formatDuration(errorStatus.duration()))
+			if errorStatus.skipped > 0 {
+				content += fmt.Sprintf(", %v error(s) skipped",
+					errorStatus.skipped)
+			}
+			content += ".\n"
+		}
+		events <- newEvent(t, kind, errorType, errorStatus, content)
+		errorStatus.notified = true
+	}
+	t.save()
+	return
+}
+
+// check connects to the target if needed and processes its slave status
+// once. It returns false if the target is not eligible to be monitored.
+func (t *Target) check() (slave bool, reconnect bool) {
+	if t.db == nil || !t.db.IsConnected() {
+		t.info("connecting to %v", t.server.Addr())
+		// a timed out connection may still be in progress, use a new one
+		t.db = t.server.New()
+		t.db.Debug = false
+		if err := t.server.Connect(t.db); err != nil {
+			t.warn("can't connect to %v: %v", t.server.Addr(), err)
+			t.connFailures++
+			t.slaveStatus, t.heartbeats = nil, nil
+			t.publish(fmt.Sprintf("can't connect: %v", err))
+			return true, true
+		}
+		t.info("connection established. start monitoring.")
+	}
+	slave, reconnect, checkErr := t.processRplStatus()
+	if reconnect {
+		t.db.Close()
+		t.connFailures++
+		if checkErr == "" {
+			checkErr = "connection lost"
+		} else {
+			checkErr = "connection lost: " + checkErr
+		}
+	}
+	if checkErr != "" {
+		// nothing of the last good check holds any more
+		t.slaveStatus, t.heartbeats = nil, nil
+	}
+	t.publish(checkErr)
+	return
+}
+
+// once connects to the target and processes its slave status once, as of
+// batch mode.
+func (t *Target) once() os.Error {
+	t.db = t.server.New()
+	if err := t.server.Connect(t.db); err != nil {
+		return fmt.Errorf("can't connect to %v: %v", t.server.Addr(), err)
+	}
+	defer t.db.Close()
+	t.processRplStatus()
+	return nil
+}
+
+// run checks the target every interval until it is found not to be a slave
+// or stopped by a reload, then sends itself to done.
+func (t *Target) run(done chan<- *Target) {
+	for stopped := false; !stopped; {
+		// a reload waits for the check, and changes the intervals
+		configLock.RLock()
+		slave, reconnect := t.check()
+		wait := *interval
+		if reconnect {
+			wait = *retryInterval
+		}
+		configLock.RUnlock()
+		if !slave {
+			// target server is not eligible to be monitored
+			break
+		}
+		if reconnect {
+			t.warn("retry in %v seconds...", wait)
+		}
+		select {
+		case <-time.After(int64(wait) * 1e9):
+		case <-t.stop:
+			stopped = true
+		}
+	}
+	if t.db != nil {
+		t.db.Close()
+	}
+	done <- t
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"bytes"
+	"exec"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// WebhookNotifier posts events as JSON to an URL, any 2xx status is a
+// success. The connection times out by notifyTimeout.
+type WebhookNotifier struct {
+	URL    string
+	client *http.Client // made by the first Notify
+}
+
+func (n *WebhookNotifier) Notify(e *Event) os.Error {
+	if n.client == nil {
+		n.client = &http.Client{Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, os.Error) {
+				return dial(network, addr, notifyTimeout)
+			}}}
+	}
+	resp, err := n.client.Post(n.URL, "application/json",
+		bytes.NewBuffer(e.JSON()))
+	if err != nil {
+		// without the URL, which may hold a token
+		if ue, ok := err.(*http.URLError); ok {
+			err = fmt.Errorf("%v %v: %v", ue.Op, n, ue.Error)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v returned %v: %s", n, resp.Status, body)
+	}
+	return nil
+}
+
+// String tells only the scheme and the host of the URL, its user info, path
+// and query may hold a token.
+func (n *WebhookNotifier) String() string {
+	i := strings.Index(n.URL, "://") + len("://")
+	host := n.URL[i:]
+	end := strings.IndexFunc(host, func(c int) bool {
+		return c == '/' || c == '?' || c == '#'
+	})
+	if end >= 0 {
+		host = host[:end]
+	}
+	if j := strings.LastIndex(host, "@"); j >= 0 {
+		host = host[j+1:]
+	}
+	return n.URL[:i] + host
+}
+
+// CommandNotifier runs a command for every event, reading the event as
+// JSON on its stdin. A non-zero exit status is an error.
+type CommandNotifier struct {
+	Command string
+}
+
+func (n *CommandNotifier) Notify(e *Event) os.Error {
+	tokens := strings.Fields(n.Command)
+	cmd := exec.Command(tokens[0], tokens[1:]...)
+	cmd.Stdin = bytes.NewBuffer(e.JSON())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %v %s", tokens[0], err, out)
+	}
+	if len(out) > 0 {
+		log.Debug("%v: %s", tokens[0], out)
+	}
+	return nil
+}
+
+func (n *CommandNotifier) String() string {
+	return "command:" + n.Command
+}
@@ -0,0 +1,175 @@
+// mtc-topology discovers the replication topology around seed instances and
+// prints it as a text tree, JSON or a Graphviz digraph, e.g.:
+//
+//     mtc-topology -format dot "h=db1,u=monitor,p=xxx" | dot -Tpng > rpl.png
+package main
+
+import (
+	"os"
+	"flag"
+	"fmt"
+
+	"mtclib"
+
+	l4g "log4go.googlecode.com/hg"
+)
+
+// output formats
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+	FORMAT_DOT  = "dot"
+)
+
+var (
+	cmdname = os.Args[0]
+	fs      = flag.NewFlagSet(cmdname, flag.ExitOnError)
+
+	// flags: general
+	verbose   = fs.Bool("v", false, "verbose output")
+	debugMode = fs.Bool("debug", false, "debug mode")
+	// flags: discovery
+	format   = fs.String("format", FORMAT_TEXT, "output format: text|json|dot")
+	depth    = fs.Int("depth", 0, "maximum hops from a seed, 0 for unlimited")
+	upOnly   = fs.Bool("up", false, "follow masters only")
+	downOnly = fs.Bool("down", false, "follow replicas only")
+	// flags: credentials
+	credFlags = mtclib.NewCredentialFlags(fs)
+	// flags: inventory
+	invFlags = mtclib.NewInventoryFlags(fs)
+
+	seeds []*mtclib.MySQLServer
+
+	// logging controls
+	log = make(l4g.Logger)
+)
+
+func parseArgs() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("Arg parsing failed: %v\n", err)
+			log.Close()
+			os.Exit(1)
+		}
+	}()
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %v [OPTIONS] NID [NID...]\n", cmdname)
+		fmt.Fprintf(os.Stderr, "  %v [OPTIONS] -inventory FILE "+
+			"(-node NAME | -cluster NAME [-role ROLE])\n\n", cmdname)
+		fmt.Fprintf(os.Stderr, "Discovered nodes are logged in as declared "+
+			"by the inventory, or with the\nfirst NID's user and password "+
+			"unless given by a credential provider.\n")
+		fmt.Fprintf(os.Stderr, "\nOPTION:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	logLevel := l4g.WARNING
+	if *verbose || *debugMode {
+		logLevel = l4g.DEBUG
+	}
+	log.AddFilter("stderr", logLevel,
+		l4g.NewFormatLogWriter(os.Stderr, "[%d %t] [%L] %M"))
+	if fs.NArg() == 0 && !invFlags.Given() {
+		log.Error("wrong args")
+		fs.Usage()
+		os.Exit(1)
+	}
+	switch *format {
+	case FORMAT_TEXT, FORMAT_JSON, FORMAT_DOT:
+	default:
+		panic(fmt.Sprintf("unknown output format: %v", *format))
+	}
+	if *depth < 0 {
+		panic(fmt.Sprintf("incorrect depth: %v", *depth))
+	}
+	if *upOnly && *downOnly {
+		panic("-up and -down can't be used together")
+	}
+	if err := credFlags.Setup(); err != nil {
+		panic(err.String())
+	}
+	var err os.Error
+	if seeds, err = invFlags.Select(""); err != nil {
+		panic(err.String())
+	}
+	if seeds != nil && fs.NArg() != 0 {
+		panic("NIDs can't be given with -inventory")
+	}
+	for _, nid := range fs.Args() {
+		server, err := mtclib.ParseNidErr(nid)
+		if err != nil {
+			log.Error("bad NID: %v", err)
+			fs.Usage()
+			log.Close()
+			os.Exit(1)
+		}
+		if err = server.ResolvePass(); err != nil {
+			panic(err.String())
+		}
+		seeds = append(seeds, server)
+	}
+}
+
+// login returns login info of a discovered node, as declared by the
+// inventory, or the first seed's user and password unless a credential
+// provider knows the node.
+func login(host string, port int) mtclib.MySQLServer {
+	inv, err := invFlags.Lookup(fmt.Sprintf("%v:%v", host, port))
+	if err != nil {
+		log.Warn("%v, use the seed's login for %v:%v", err, host, port)
+	} else if inv != nil {
+		return *inv
+	}
+	seed := seeds[0]
+	server := mtclib.MySQLServer{
+		Host:    host,
+		Port:    port,
+		User:    seed.User,
+		Charset: seed.Charset,
+		Timeout: seed.Timeout}
+	if !seed.PassGiven() {
+		if err := server.ResolvePass(); err != nil {
+			log.Warn("%v, use the seed's password for %v:%v", err, host,
+				port)
+		}
+	}
+	if server.Pass == "" {
+		server.Pass = seed.Pass
+	}
+	return server
+}
+
+func main() {
+	parseArgs()
+	topo := mtclib.NewTopology()
+	topo.Masters = !*downOnly
+	topo.Replicas = !*upOnly
+	topo.Depth = *depth
+	topo.Login = login
+	err := topo.Discover(seeds...)
+	if err == nil {
+		for _, node := range topo.Nodes {
+			if node.Error != "" {
+				log.Warn("%v: %v", node, node.Error)
+			} else {
+				log.Debug("%v found by %v", node, node.Found)
+			}
+		}
+		switch *format {
+		case FORMAT_TEXT:
+			err = topo.WriteText(os.Stdout)
+		case FORMAT_JSON:
+			err = topo.WriteJSON(os.Stdout)
+		case FORMAT_DOT:
+			err = topo.WriteDOT(os.Stdout)
+		}
+	}
+	if err != nil {
+		log.Error(err)
+		log.Close()
+		os.Exit(1)
+	}
+	log.Close()
+}
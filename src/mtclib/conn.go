@@ -0,0 +1,69 @@
+package mtclib
+
+import (
+	"os"
+	"fmt"
+	"strconv"
+	"time"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// Proto returns the protocol and address to pass to mysql.New, a unix socket
+// if Socket is set, or TCP to Host and Port.
+func (server *MySQLServer) Proto() (proto, addr string) {
+	if server.Socket != "" {
+		return "unix", server.Socket
+	}
+	return "tcp", server.Host + ":" + strconv.Itoa(server.Port)
+}
+
+// Addr returns the address of the server for messages.
+func (server *MySQLServer) Addr() string {
+	_, addr := server.Proto()
+	return addr
+}
+
+// New returns a connection to the server, not connected yet. The charset
+// (utf8 by default) is set on every connect, and the default database is
+// selected if set.
+func (server *MySQLServer) New() *mysql.MySQL {
+	proto, addr := server.Proto()
+	var db *mysql.MySQL
+	if server.Db != "" {
+		db = mysql.New(proto, "", addr, server.User, server.Pass, server.Db)
+	} else {
+		db = mysql.New(proto, "", addr, server.User, server.Pass)
+	}
+	charset := server.Charset
+	if charset == "" {
+		charset = "utf8"
+	}
+	db.Register("SET NAMES " + charset)
+	return db
+}
+
+// Connect connects db made by New, giving up after the connect timeout of
+// the server. db should be dropped after a timeout, as the attempt goes on
+// in background and its connection is closed once established.
+func (server *MySQLServer) Connect(db *mysql.MySQL) os.Error {
+	if server.Timeout <= 0 {
+		return db.Connect()
+	}
+	done := make(chan os.Error, 1)
+	go func() {
+		done <- db.Connect()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(int64(server.Timeout) * 1e9):
+	}
+	go func() {
+		if <-done == nil {
+			db.Close()
+		}
+	}()
+	return fmt.Errorf("can't connect to %v in %v seconds", server.Addr(),
+		server.Timeout)
+}
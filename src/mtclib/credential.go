@@ -0,0 +1,244 @@
+package mtclib
+
+import (
+	"os"
+	"bufio"
+	"bytes"
+	"exec"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CredentialProvider looks up the login of a server whose password is not
+// given by its NID.
+type CredentialProvider interface {
+	// Credential returns the user and password of server, or "" for both if
+	// the provider doesn't know the server. user is "" if it is left to the
+	// NID.
+	Credential(server *MySQLServer) (user, pass string, err os.Error)
+	String() string
+}
+
+// CheckSecret refuses a credentials file readable or writable by others.
+func CheckSecret(path string) os.Error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode&0006 != 0 {
+		return fmt.Errorf("%v is accessible by others (mode %o), "+
+			"chmod 600 it", path, fi.Mode&0777)
+	}
+	return nil
+}
+
+// EnvCredential reads the password from the environment: MTC_PASSWORD_h_P
+// (non alphanumeric characters of the host h replaced by '_') for a single
+// server, else MTC_PASSWORD, else MYSQL_PWD. MTC_USER gives the user if set.
+type EnvCredential struct{}
+
+func (EnvCredential) Credential(server *MySQLServer) (string, string,
+	os.Error) {
+
+	host := []byte(server.Host)
+	for i, c := range host {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			'0' <= c && c <= '9') {
+			host[i] = '_'
+		}
+	}
+	for _, name := range []string{
+		fmt.Sprintf("MTC_PASSWORD_%s_%v", host, server.Port),
+		"MTC_PASSWORD",
+		"MYSQL_PWD"} {
+		if pass := os.Getenv(name); pass != "" {
+			return os.Getenv("MTC_USER"), pass, nil
+		}
+	}
+	return "", "", nil
+}
+
+func (EnvCredential) String() string {
+	return "environment"
+}
+
+// FileCredential reads a credentials file of lines like:
+//
+//     host:port user password
+//
+// where host or port may be "*" to match any, the first line matching the
+// server (and its user if given by the NID) is used. Empty lines and lines
+// starting with '#' are ignored. The file should not be accessible by others.
+type FileCredential struct {
+	Path string
+}
+
+func (f *FileCredential) Credential(server *MySQLServer) (string, string,
+	os.Error) {
+
+	if err := CheckSecret(f.Path); err != nil {
+		return "", "", err
+	}
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	rd := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != os.EOF {
+			return "", "", err
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			colon := strings.LastIndex(fields[0], ":")
+			if len(fields) != 3 || colon < 0 {
+				return "", "", fmt.Errorf("%v:%v: mulformed line, "+
+					"should be 'host:port user password'", f.Path, n)
+			}
+			host, port := fields[0][:colon], fields[0][colon+1:]
+			if (host == "*" || host == server.Host) &&
+				(port == "*" || port == strconv.Itoa(server.Port)) &&
+				(server.User == "" || server.User == fields[1]) {
+				return fields[1], fields[2], nil
+			}
+		}
+		if err == os.EOF {
+			break
+		}
+	}
+	return "", "", nil
+}
+
+func (f *FileCredential) String() string {
+	return f.Path
+}
+
+// MyCnfCredential reads user and password of the [client] group of a my.cnf
+// style option file, for any server. A missing file provides nothing.
+type MyCnfCredential struct {
+	Path string
+}
+
+func (f *MyCnfCredential) Credential(server *MySQLServer) (string, string,
+	os.Error) {
+
+	if _, err := os.Stat(f.Path); err != nil {
+		return "", "", nil
+	}
+	if err := CheckSecret(f.Path); err != nil {
+		return "", "", err
+	}
+	opts, err := ReadOptionFile(f.Path, "client")
+	if err != nil {
+		return "", "", err
+	}
+	if opts["password"] == "" {
+		return "", "", nil
+	}
+	return opts["user"], opts["password"], nil
+}
+
+func (f *MyCnfCredential) String() string {
+	return f.Path
+}
+
+// CommandCredential runs an external helper with the host, port and user of
+// the server as arguments, the first line of its output is the password. The
+// helper should exit with status 0 and print nothing if it doesn't know the
+// server.
+type CommandCredential struct {
+	Command string
+}
+
+func (c *CommandCredential) Credential(server *MySQLServer) (string, string,
+	os.Error) {
+
+	tokens := strings.Fields(c.Command)
+	args := append(tokens[1:], server.Host, strconv.Itoa(server.Port),
+		server.User)
+	cmd := exec.Command(tokens[0], args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("credential helper %v: %v", tokens[0], err)
+	}
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		out = out[:i]
+	}
+	return "", strings.TrimRight(string(out), "\r"), nil
+}
+
+func (c *CommandCredential) String() string {
+	return "helper " + c.Command
+}
+
+// Credentials are the providers consulted in order by ResolvePass, by
+// default the environment then ~/.my.cnf.
+var Credentials = []CredentialProvider{
+	EnvCredential{},
+	&MyCnfCredential{filepath.Join(os.Getenv("HOME"), ".my.cnf")}}
+
+// CredentialFlags are command line flags of credential providers.
+type CredentialFlags struct {
+	file   *string
+	helper *string
+}
+
+// NewCredentialFlags adds -credentials and -credential-helper flags to fs.
+func NewCredentialFlags(fs *flag.FlagSet) *CredentialFlags {
+	return &CredentialFlags{
+		file: fs.String("credentials", "", "credentials file of "+
+			"'host:port user password' lines, consulted when p= is absent"),
+		helper: fs.String("credential-helper", "", "command printing the "+
+			"password of HOST PORT USER, consulted when p= is absent")}
+}
+
+// Setup sets Credentials according to the flags: the environment, the
+// credentials file, the helper, then ~/.my.cnf.
+func (f *CredentialFlags) Setup() os.Error {
+	providers := []CredentialProvider{EnvCredential{}}
+	if *f.file != "" {
+		if err := CheckSecret(*f.file); err != nil {
+			return err
+		}
+		providers = append(providers, &FileCredential{*f.file})
+	}
+	if strings.TrimSpace(*f.helper) != "" {
+		providers = append(providers, &CommandCredential{*f.helper})
+	}
+	Credentials = append(providers,
+		&MyCnfCredential{filepath.Join(os.Getenv("HOME"), ".my.cnf")})
+	return nil
+}
+
+// ResolvePass looks up the password of server from Credentials unless it
+// was given by its NID, the user is also taken from the provider if not
+// given. It is not an error if no provider knows the server. PassGiven stays
+// false for a password from a provider.
+func (server *MySQLServer) ResolvePass() os.Error {
+	if server.passGiven {
+		return nil
+	}
+	return server.resolvePass(Credentials)
+}
+
+func (server *MySQLServer) resolvePass(providers []CredentialProvider) os.Error {
+	for _, provider := range providers {
+		user, pass, err := provider.Credential(server)
+		if err != nil {
+			return fmt.Errorf("credentials from %v: %v", provider, err)
+		}
+		if pass != "" {
+			if server.User == "" {
+				server.User = user
+			}
+			server.Pass = pass
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package mtclib
+
+import (
+	"os"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// default heartbeat table written by mtc-heartbeat
+const HEARTBEAT_TABLE = "mtc.heartbeat"
+
+// Heartbeat is the last heartbeat of an originating server seen on a
+// replica.
+type Heartbeat struct {
+	ServerId int64
+	Time     int64 // when it was written, in microseconds since the epoch
+	Delay    int64 // from Time to now, in microseconds
+}
+
+// heartbeatName quotes a table name like "db.table" for queries, with its
+// database.
+func heartbeatName(table string) (db, name string, err os.Error) {
+	parts := strings.Split(table, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("heartbeat table should be DB.TABLE: %v",
+			table)
+	}
+	for i, part := range parts {
+		parts[i] = QuoteName(part)
+	}
+	return parts[0], strings.Join(parts, "."), nil
+}
+
+// CreateHeartbeat creates the heartbeat table and its database if missing.
+func CreateHeartbeat(db *mysql.MySQL, table string) os.Error {
+	dbName, name, err := heartbeatName(table)
+	if err != nil {
+		return err
+	}
+	_, _, err = db.Query("CREATE DATABASE IF NOT EXISTS %v", dbName)
+	if err != nil {
+		return err
+	}
+	_, _, err = db.Query("CREATE TABLE IF NOT EXISTS %v ("+
+		"server_id INT UNSIGNED NOT NULL PRIMARY KEY, "+
+		"ts BIGINT NOT NULL COMMENT 'microseconds since the epoch'"+
+		") ENGINE=InnoDB", name)
+	return err
+}
+
+// ServerId returns the server_id of the server of db.
+func ServerId(db *mysql.MySQL) (int64, os.Error) {
+	rows, _, err := db.Query("SELECT @@server_id")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi64(rows[0].Str(0))
+}
+
+// WriteHeartbeat writes the current time as the heartbeat of serverId, the
+// server_id of the server of db given by ServerId. Both are written as
+// literals, not taken by MySQL, so they replicate the same with statement
+// and row based binlog: @@server_id or NOW() would be evaluated again by
+// every replica under statement based.
+func WriteHeartbeat(db *mysql.MySQL, table string, serverId int64) os.Error {
+	_, name, err := heartbeatName(table)
+	if err != nil {
+		return err
+	}
+	_, _, err = db.Query("REPLACE INTO %v (server_id, ts) VALUES (%v, %v)",
+		name, serverId, time.Nanoseconds()/1e3)
+	return err
+}
+
+// ReadHeartbeats returns heartbeats of other servers replicated to the
+// server of db. Delays are computed by the local clock, which should be
+// synchronized with the clocks of the writers.
+func ReadHeartbeats(db *mysql.MySQL, table string) ([]*Heartbeat, os.Error) {
+	_, name, err := heartbeatName(table)
+	if err != nil {
+		return nil, err
+	}
+	rows, _, err := db.Query("SELECT server_id, ts FROM %v "+
+		"WHERE server_id <> @@server_id ORDER BY server_id", name)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Nanoseconds() / 1e3
+	beats := make([]*Heartbeat, 0, len(rows))
+	for _, row := range rows {
+		beat := new(Heartbeat)
+		if beat.ServerId, err = strconv.Atoi64(row.Str(0)); err != nil {
+			return nil, fmt.Errorf("bad server_id in %v: %v", table, err)
+		}
+		if beat.Time, err = strconv.Atoi64(row.Str(1)); err != nil {
+			return nil, fmt.Errorf("bad ts in %v: %v", table, err)
+		}
+		beat.Delay = now - beat.Time
+		beats = append(beats, beat)
+	}
+	return beats, nil
+}
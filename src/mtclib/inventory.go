@@ -0,0 +1,413 @@
+package mtclib
+
+import (
+	"os"
+	"bufio"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Inventory declares clusters and nodes of MySQL instances, read from an INI
+// style file like:
+//
+//     # clusters give defaults to their nodes
+//     [cluster shop]
+//     user = monitor
+//     credentials = /etc/mtc/shop.credentials
+//
+//     [node shop-db1]
+//     cluster = shop
+//     nid = h=db1.shop,P=3306
+//     role = master
+//
+//     [node shop-db2]
+//     cluster = shop
+//     nid = h=db2.shop,P=3306
+//     role = slave, backup
+//
+// Keys of a node are nid (required), cluster, role (a list delimited by ','),
+// and those of a cluster: user, credentials (a credentials file, see
+// FileCredential) and credential-helper (see CommandCredential). A node
+// overrides the keys of its cluster.
+type Inventory struct {
+	Path     string
+	Clusters []*Cluster
+	Nodes    []*InventoryNode // in order of the file
+}
+
+// Cluster is a named group of inventory nodes.
+type Cluster struct {
+	Name     string
+	Nodes    []*InventoryNode
+	login    inventoryLogin
+	declared bool // by a section, not only referred by nodes
+}
+
+// InventoryNode is a MySQL instance of an inventory.
+type InventoryNode struct {
+	Name    string
+	Nid     string
+	Cluster *Cluster // nil if not in a cluster
+	Roles   []string
+	login   inventoryLogin
+	server  *MySQLServer
+}
+
+// inventoryLogin is the login info given by a cluster or a node, "" if not
+// given.
+type inventoryLogin struct {
+	user   string
+	file   string
+	helper string
+}
+
+// ReadInventory loads an inventory file. NIDs of nodes are checked, but
+// credentials are only looked up by InventoryNode.Server.
+func ReadInventory(path string) (*Inventory, os.Error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	inv := &Inventory{Path: path}
+	var cluster *Cluster
+	var node *InventoryNode
+	rd := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != os.EOF {
+			return nil, err
+		}
+		if perr := inv.parseLine(strings.TrimSpace(line), &cluster,
+			&node); perr != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, n, perr)
+		}
+		if err == os.EOF {
+			break
+		}
+	}
+	for _, node := range inv.Nodes {
+		if node.Nid == "" {
+			return nil, fmt.Errorf("%v: node %v has no nid", path, node.Name)
+		}
+	}
+	return inv, nil
+}
+
+// parseLine parses a line of an inventory file, *cluster or *node is the
+// current section.
+func (inv *Inventory) parseLine(line string, cluster **Cluster,
+	node **InventoryNode) os.Error {
+
+	switch {
+	case line == "" || line[0] == '#' || line[0] == ';':
+		return nil
+	case line[0] == '[':
+		if !strings.HasSuffix(line, "]") {
+			return fmt.Errorf("bad section: %v", line)
+		}
+		fields := strings.Fields(line[1 : len(line)-1])
+		if len(fields) != 2 {
+			return fmt.Errorf("bad section, should be [cluster NAME] or "+
+				"[node NAME]: %v", line)
+		}
+		*cluster, *node = nil, nil
+		switch fields[0] {
+		case "cluster":
+			*cluster = inv.cluster(fields[1])
+			if (*cluster).declared {
+				return fmt.Errorf("duplicate cluster: %v", fields[1])
+			}
+			(*cluster).declared = true
+		case "node":
+			if inv.Node(fields[1]) != nil {
+				return fmt.Errorf("duplicate node: %v", fields[1])
+			}
+			*node = &InventoryNode{Name: fields[1]}
+			inv.Nodes = append(inv.Nodes, *node)
+		default:
+			return fmt.Errorf("unknown section: %v", fields[0])
+		}
+		return nil
+	}
+	// values are not told by errors, a nid may hold a password
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return os.NewError("option without value")
+	}
+	name := strings.TrimSpace(line[:i])
+	if *cluster == nil && *node == nil {
+		return fmt.Errorf("option outside of a section: %v", name)
+	}
+	value, err := optionValue(line[i+1:])
+	if err != nil {
+		return fmt.Errorf("%v of %v", err, name)
+	}
+	var login *inventoryLogin
+	if *cluster != nil {
+		login = &(*cluster).login
+	} else {
+		login = &(*node).login
+	}
+	switch name {
+	case "user":
+		login.user = value
+	case "credentials":
+		login.file = value
+	case "credential-helper":
+		login.helper = value
+	case "nid", "cluster", "role":
+		if *node == nil {
+			return fmt.Errorf("%v is only an option of nodes", name)
+		}
+		return inv.setNode(*node, name, value)
+	default:
+		return fmt.Errorf("unknown option: %v", name)
+	}
+	return nil
+}
+
+func (inv *Inventory) setNode(node *InventoryNode, name, value string) (
+	err os.Error) {
+
+	switch name {
+	case "nid":
+		if node.server, err = ParseNidErr(value); err != nil {
+			return fmt.Errorf("node %v: %v", node.Name, err)
+		}
+		node.Nid = value
+	case "cluster":
+		if node.Cluster != nil {
+			return fmt.Errorf("node %v is already in cluster %v", node.Name,
+				node.Cluster.Name)
+		}
+		node.Cluster = inv.cluster(value)
+		node.Cluster.Nodes = append(node.Cluster.Nodes, node)
+	case "role":
+		for _, role := range strings.Split(value, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				node.Roles = append(node.Roles, role)
+			}
+		}
+	}
+	return nil
+}
+
+// cluster returns the named cluster, created if unknown.
+func (inv *Inventory) cluster(name string) *Cluster {
+	if c := inv.Cluster(name); c != nil {
+		return c
+	}
+	c := &Cluster{Name: name}
+	inv.Clusters = append(inv.Clusters, c)
+	return c
+}
+
+// Cluster returns the named cluster, or nil.
+func (inv *Inventory) Cluster(name string) *Cluster {
+	for _, c := range inv.Clusters {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Node returns the named node, or nil.
+func (inv *Inventory) Node(name string) *InventoryNode {
+	for _, node := range inv.Nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// Lookup returns the node at "host:port", or nil.
+func (inv *Inventory) Lookup(addr string) *InventoryNode {
+	for _, node := range inv.Nodes {
+		if node.Addr() == addr {
+			return node
+		}
+	}
+	return nil
+}
+
+// Select returns the named node, or nodes of the named cluster having role
+// if not "". A node given with a cluster should be in it.
+func (inv *Inventory) Select(cluster, node, role string) ([]*InventoryNode,
+	os.Error) {
+
+	var c *Cluster
+	if cluster != "" {
+		if c = inv.Cluster(cluster); c == nil {
+			return nil, fmt.Errorf("no cluster %v in %v", cluster, inv.Path)
+		}
+	}
+	if node != "" {
+		n := inv.Node(node)
+		if n == nil {
+			return nil, fmt.Errorf("no node %v in %v", node, inv.Path)
+		}
+		if c != nil && n.Cluster != c {
+			return nil, fmt.Errorf("node %v is not in cluster %v", node,
+				cluster)
+		}
+		return []*InventoryNode{n}, nil
+	}
+	if c == nil {
+		return nil, os.NewError("either a cluster or a node should be given")
+	}
+	nodes := make([]*InventoryNode, 0, len(c.Nodes))
+	for _, n := range c.Nodes {
+		if role == "" || n.HasRole(role) {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 0 && role != "" {
+		return nil, fmt.Errorf("no node of role %v in cluster %v", role,
+			cluster)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no node in cluster %v", cluster)
+	}
+	return nodes, nil
+}
+
+// HasRole tells if the node has role.
+func (node *InventoryNode) HasRole(role string) bool {
+	for _, r := range node.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Addr returns "host:port" of the node.
+func (node *InventoryNode) Addr() string {
+	return fmt.Sprintf("%v:%v", node.server.Host, node.server.Port)
+}
+
+func (node *InventoryNode) String() string {
+	return node.Name
+}
+
+// Server returns login info of the node. The user defaults to the one of
+// the node, then of its cluster. Unless the NID gives the password, the
+// credentials file and helper of the node or its cluster are consulted
+// before Credentials.
+func (node *InventoryNode) Server() (*MySQLServer, os.Error) {
+	server := new(MySQLServer)
+	*server = *node.server
+	var cluster inventoryLogin
+	if node.Cluster != nil {
+		cluster = node.Cluster.login
+	}
+	if server.User == "" {
+		server.User = node.login.user
+	}
+	if server.User == "" {
+		server.User = cluster.user
+	}
+	if server.passGiven {
+		return server, nil
+	}
+	providers := make([]CredentialProvider, 0, 4)
+	for _, login := range []inventoryLogin{node.login, cluster} {
+		if login.file != "" {
+			providers = append(providers, &FileCredential{login.file})
+		}
+		if login.helper != "" {
+			providers = append(providers, &CommandCredential{login.helper})
+		}
+	}
+	if err := server.resolvePass(providers); err != nil {
+		return nil, fmt.Errorf("node %v: %v", node.Name, err)
+	}
+	if server.Pass == "" {
+		if err := server.ResolvePass(); err != nil {
+			return nil, fmt.Errorf("node %v: %v", node.Name, err)
+		}
+	}
+	return server, nil
+}
+
+// InventoryFlags are command line flags selecting nodes of an inventory in
+// place of NIDs.
+type InventoryFlags struct {
+	path    *string
+	cluster *string
+	node    *string
+	role    *string
+
+	Inventory *Inventory // loaded by Select
+}
+
+// NewInventoryFlags adds -inventory, -cluster, -node and -role flags to fs.
+func NewInventoryFlags(fs *flag.FlagSet) *InventoryFlags {
+	return &InventoryFlags{
+		path: fs.String("inventory", "", "inventory file of clusters "+
+			"and nodes, to select nodes by -cluster or -node instead of NIDs"),
+		cluster: fs.String("cluster", "", "select nodes of this cluster "+
+			"of the inventory"),
+		node: fs.String("node", "", "select this node of the inventory"),
+		role: fs.String("role", "", "select nodes of the cluster "+
+			"having this role")}
+}
+
+// Given tells if an inventory is given.
+func (f *InventoryFlags) Given() bool {
+	return *f.path != ""
+}
+
+// Select loads the inventory and returns login info of the selected nodes.
+// defaultRole is used if a cluster is selected without a node or role.
+func (f *InventoryFlags) Select(defaultRole string) ([]*MySQLServer,
+	os.Error) {
+
+	if !f.Given() {
+		if *f.cluster != "" || *f.node != "" || *f.role != "" {
+			return nil, os.NewError("-cluster, -node and -role require " +
+				"-inventory")
+		}
+		return nil, nil
+	}
+	if *f.role != "" && *f.cluster == "" {
+		return nil, os.NewError("-role requires -cluster")
+	}
+	inv, err := ReadInventory(*f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.Inventory = inv
+	role := *f.role
+	if role == "" && *f.node == "" {
+		role = defaultRole
+	}
+	nodes, err := inv.Select(*f.cluster, *f.node, role)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]*MySQLServer, len(nodes))
+	for i, node := range nodes {
+		if servers[i], err = node.Server(); err != nil {
+			return nil, err
+		}
+	}
+	return servers, nil
+}
+
+// Lookup returns login info of the inventory node at "host:port", or nil if
+// no inventory is loaded or no node matches.
+func (f *InventoryFlags) Lookup(addr string) (*MySQLServer, os.Error) {
+	if f.Inventory == nil {
+		return nil, nil
+	}
+	node := f.Inventory.Lookup(addr)
+	if node == nil {
+		return nil, nil
+	}
+	return node.Server()
+}
@@ -0,0 +1,187 @@
+package mtclib
+
+import (
+	"os"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"json"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// name of the manifest file inside of a mtc-cordump image directory
+const ManifestName = "manifest.json"
+
+// compression of image files
+const (
+	COMPRESS_NONE = ""
+	COMPRESS_GZIP = "gzip"
+)
+
+// data formats of image files
+const (
+	FORMAT_SQL = "sql"
+	FORMAT_TSV = "tsv"
+	FORMAT_CSV = "csv"
+)
+
+// QuoteName quotes a database or table name by backquotes.
+func QuoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// Coordinate is the point-in-time binlog position of a node in a replication
+// chain, at which a mtc-cordump image was taken.
+type Coordinate struct {
+	Name    string `json:"name"` // N1 for the root, N2 for its slave, etc.
+	Addr    string `json:"addr"` // host:port
+	LogFile string `json:"log_file"`
+	LogPos  int64  `json:"log_pos"`
+	Time    string `json:"time"`
+}
+
+// String formats the coordinate like:
+//
+//     N1: mysql-bin.000005 48471238 "2011-09-12 12:32:49" remote1:3306
+//
+// with "- -" in place of the binlog position if binlog is disabled.
+func (c *Coordinate) String() string {
+	if c.LogFile == "" {
+		return fmt.Sprintf("%v: - - %q %v", c.Name, c.Time, c.Addr)
+	}
+	return fmt.Sprintf("%v: %v %v %q %v", c.Name, c.LogFile, c.LogPos, c.Time,
+		c.Addr)
+}
+
+var coordinateRe = regexp.MustCompile(
+	`^(N[0-9]+): ([^ ]+) ([^ ]+) (".*") ([^ ]+)$`)
+
+// ParseCoordinate parses a coordinate formatted by Coordinate.String.
+func ParseCoordinate(str string) (*Coordinate, os.Error) {
+	m := coordinateRe.FindStringSubmatch(str)
+	if m == nil {
+		return nil, fmt.Errorf("mulformed coordinate: '%v'", str)
+	}
+	c := &Coordinate{Name: m[1], Addr: m[5]}
+	var err os.Error
+	if c.Time, err = strconv.Unquote(m[4]); err != nil {
+		return nil, fmt.Errorf("mulformed coordinate: '%v'", str)
+	}
+	if m[2] == "-" {
+		return c, nil
+	}
+	c.LogFile = m[2]
+	if c.LogPos, err = strconv.Atoi64(m[3]); err != nil {
+		return nil, fmt.Errorf("mulformed coordinate: '%v'", str)
+	}
+	return c, nil
+}
+
+// DumpFile is a file of a mtc-cordump image. A table is either dumped into a
+// single file, or split by ranges of its primary key into a file holding the
+// table structure (Chunk 0) and Chunks files holding the data (Chunk 1 to
+// Chunks). Data of a tsv or csv image is always in separated files, a table
+// not split is written as a single chunk with an empty Range.
+type DumpFile struct {
+	Name   string `json:"name"` // relative to the image directory
+	Db     string `json:"db"`
+	Table  string `json:"table"` // empty for database definitions
+	Chunk  int    `json:"chunk"`
+	Chunks int    `json:"chunks"` // 0 if the table is not chunked
+	Range  string `json:"range"`  // condition of the chunk
+	Rows   int64  `json:"rows"`
+	Sha256 string `json:"sha256"` // hex of the file as stored, compressed or not
+}
+
+// Manifest describes a mtc-cordump image stored in a directory.
+type Manifest struct {
+	Source      string        `json:"source"` // host:port of the dumped node
+	Time        string        `json:"time"`
+	Format      string        `json:"format"`      // of data files: sql, tsv or csv
+	Compression string        `json:"compression"` // file names end with ".gz" if gzip
+	Chain       []*Coordinate `json:"chain"`       // from root to leaf
+	Files       []*DumpFile   `json:"files"`
+}
+
+// Coordinate returns the coordinate of the named node, or nil.
+func (m *Manifest) Coordinate(name string) *Coordinate {
+	for _, c := range m.Chain {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// ReadManifest loads the manifest of the image in dir.
+func ReadManifest(dir string) (*Manifest, os.Error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(Manifest)
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("bad manifest in %v: %v", dir, err)
+	}
+	return manifest, nil
+}
+
+// Write saves the manifest into dir.
+func (m *Manifest) Write(dir string) os.Error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ManifestName), data, 0644)
+}
+
+// Checksum returns the hex encoded SHA-256 of the file at path.
+func Checksum(path string) (string, os.Error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum()), nil
+}
+
+// gzipFile closes both the decompressor and the underlying file.
+type gzipFile struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (f *gzipFile) Close() os.Error {
+	err := f.ReadCloser.Close()
+	if err1 := f.file.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// OpenFile opens a file of an image (or a single file dump) for reading, the
+// content of a file named "*.gz" is decompressed transparently.
+func OpenFile(path string) (io.ReadCloser, os.Error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &gzipFile{zr, file}, nil
+}
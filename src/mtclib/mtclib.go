@@ -1,52 +1,264 @@
 package mtclib
 
 import (
+	"os"
+	"bytes"
 	"fmt"
 	"strings"
 	"strconv"
 )
 
 type MySQLServer struct {
-	Host string
-	Port int
-	User string
-	Pass string
+	Host    string
+	Port    int
+	Socket  string // unix socket, used instead of Host and Port if set
+	User    string
+	Pass    string
+	Db      string // default database
+	Charset string // "" for utf8
+	Timeout int    // connect timeout in seconds, 0 for none
+
+	passGiven bool // by the NID or its option file
 }
 
-func ParseNid(nidStr string) *MySQLServer {
-	defer func() {
-		if err := recover(); err != nil {
-			panic(fmt.Sprintf("ParseNid('%v')->%v", nidStr, err))
+// PassGiven tells if the password was given by the NID, even if empty.
+func (server *MySQLServer) PassGiven() bool {
+	return server.passGiven
+}
+
+// kinds of NidError
+const (
+	NID_MALFORMED     = iota // a token without '=', or an unterminated quote
+	NID_UNKNOWN_KEY          // a key other than h, P, u, p, S, D, A, T and F
+	NID_DUPLICATE_KEY        // a key given twice
+	NID_BAD_PORT             // a port not a number from 0 to 65535
+	NID_EMPTY_VALUE          // a key without value, '' is an empty value
+	NID_BAD_VALUE            // other bad values, like a bad option file
+)
+
+// NidError is an error of ParseNidErr. Values of the password are never
+// reported, nor is the text of a mulformed NID, which may be a password
+// holding ',' or '='. An unknown key right after an unquoted password is
+// taken as a part of it, and reported as NID_MALFORMED.
+type NidError struct {
+	Kind   int
+	Key    string // of a NID_MALFORMED, the key before Offset if any
+	Value  string
+	Offset int      // of a NID_MALFORMED, in bytes
+	Err    os.Error // cause of a NID_BAD_VALUE if any
+}
+
+func (e *NidError) String() string {
+	value := e.Value
+	if e.Key == "p" {
+		value = "***"
+	}
+	switch e.Kind {
+	case NID_MALFORMED:
+		if e.Key == "" {
+			return fmt.Sprintf("mulformed NID at byte %v", e.Offset)
 		}
-	}()
+		return fmt.Sprintf("mulformed NID at byte %v, after %v=%v",
+			e.Offset, e.Key, value)
+	case NID_UNKNOWN_KEY:
+		return fmt.Sprintf("unknown NID key: %v", e.Key)
+	case NID_DUPLICATE_KEY:
+		return fmt.Sprintf("duplicate NID key: %v", e.Key)
+	case NID_BAD_PORT:
+		return fmt.Sprintf("incorrect port: %v", value)
+	case NID_EMPTY_VALUE:
+		return fmt.Sprintf("empty value of NID key %v", e.Key)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("bad value of NID key %v: %v", e.Key, e.Err)
+	}
+	return fmt.Sprintf("bad value of NID key %v: %v", e.Key, value)
+}
+
+// nidKeys are valid NID keys in the order of MySQLServer.String
+const nidKeys = "hPSupDATF"
 
+// splitNid splits a NID into keys and values. A value may be quoted by ' or
+// ", with the quote doubled inside, to hold ',' or '='.
+func splitNid(nidStr string) (keys, values []string, err os.Error) {
+	quoted := make([]bool, 0)
+	offsets := make([]int, 0) // of the keys
+	for rest := nidStr; ; {
+		eq := strings.Index(rest, "=")
+		comma := strings.Index(rest, ",")
+		if eq < 0 || comma >= 0 && comma < eq {
+			// only the key and value before are known to be no password
+			err := &NidError{Kind: NID_MALFORMED,
+				Offset: len(nidStr) - len(rest)}
+			if len(keys) > 0 {
+				err.Key = keys[len(keys)-1]
+				err.Value = values[len(values)-1]
+			}
+			return nil, nil, err
+		}
+		key := rest[:eq]
+		offsets = append(offsets, len(nidStr)-len(rest))
+		rest = rest[eq+1:]
+		value := new(bytes.Buffer)
+		if rest != "" && (rest[0] == '\'' || rest[0] == '"') {
+			quote := rest[0]
+			i := 1
+			for ; i < len(rest); i++ {
+				if rest[i] == quote {
+					if i+1 < len(rest) && rest[i+1] == quote {
+						i++
+					} else {
+						break
+					}
+				}
+				value.WriteByte(rest[i])
+			}
+			if i >= len(rest) || i+1 < len(rest) && rest[i+1] != ',' {
+				return nil, nil, &NidError{Kind: NID_MALFORMED, Key: key,
+					Offset: len(nidStr) - len(rest)}
+			}
+			rest = rest[i+1:]
+			quoted = append(quoted, true)
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(rest[:end])
+			rest = rest[end:]
+			quoted = append(quoted, false)
+		}
+		keys = append(keys, key)
+		values = append(values, value.String())
+		if rest == "" {
+			break
+		}
+		// skip ','
+		rest = rest[1:]
+	}
+	for i, key := range keys {
+		switch {
+		case len(key) != 1 || strings.Index(nidKeys, key) < 0:
+			if i > 0 && keys[i-1] == "p" && !quoted[i-1] {
+				// likely the rest of a password holding ',', unquoted
+				return nil, nil, &NidError{Kind: NID_MALFORMED, Key: "p",
+					Offset: offsets[i]}
+			}
+			return nil, nil, &NidError{Kind: NID_UNKNOWN_KEY, Key: key}
+		case values[i] == "" && !quoted[i]:
+			return nil, nil, &NidError{Kind: NID_EMPTY_VALUE, Key: key}
+		}
+		for _, prev := range keys[:i] {
+			if prev == key {
+				return nil, nil, &NidError{Kind: NID_DUPLICATE_KEY, Key: key}
+			}
+		}
+	}
+	return
+}
+
+// ParseNidErr parses a NID like "h=host,P=port,u=user,p=pass". Besides h, P,
+// u and p, keys are S (unix socket), D (default database), A (charset), T
+// (connect timeout in seconds) and F (a my.cnf style option file whose
+// [client] group gives defaults to the other keys, wherever F is placed).
+// Values holding ',' or '=' can be quoted like p='a,b', or p="it''s" with the
+// quote doubled. Errors are of type *NidError.
+func ParseNidErr(nidStr string) (*MySQLServer, os.Error) {
+	keys, values, err := splitNid(nidStr)
+	if err != nil {
+		return nil, err
+	}
 	server := &MySQLServer{
 		Host: "localhost",
 		Port: 3306}
-	for _, token := range strings.Split(nidStr, ",") {
-		kv := strings.Split(token, "=")
-		if len(kv) != 2 {
-			panic(fmt.Sprintf("mulformed NID: '%v'", token))
+	for i, key := range keys {
+		if key != "F" {
+			continue
+		}
+		opts, err := ReadOptionFile(values[i], "client")
+		if err == nil {
+			err = server.SetOptions(opts)
+		}
+		if err != nil {
+			return nil, &NidError{Kind: NID_BAD_VALUE, Key: key,
+				Value: values[i], Err: err}
 		}
-		switch kv[0] {
+	}
+	for i, key := range keys {
+		value := values[i]
+		switch key {
 		case "h":
-			server.Host = kv[1]
+			server.Host = value
 		case "P":
-			port, err := strconv.Atoi(kv[1])
-			if err != nil {
-				panic(fmt.Sprintf("port should be a number: %v", server.Port))
-			}
-			if server.Port < 0 || server.Port > 65535 {
-				panic(fmt.Sprintf("incorrect port range: %v", server.Port))
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return nil, &NidError{Kind: NID_BAD_PORT, Key: key,
+					Value: value}
 			}
 			server.Port = port
 		case "u":
-			server.User = kv[1]
+			server.User = value
 		case "p":
-			server.Pass = kv[1]
-		default:
-			panic(fmt.Sprintf("mulformed NID: %v=%v", kv[0], kv[1]))
+			server.Pass = value
+			server.passGiven = true
+		case "S":
+			server.Socket = value
+		case "D":
+			server.Db = value
+		case "A":
+			server.Charset = value
+		case "T":
+			timeout, err := strconv.Atoi(value)
+			if err != nil || timeout < 0 {
+				return nil, &NidError{Kind: NID_BAD_VALUE, Key: key,
+					Value: value}
+			}
+			server.Timeout = timeout
 		}
 	}
+	return server, nil
+}
+
+// ParseNid is like ParseNidErr but panics on errors.
+func ParseNid(nidStr string) *MySQLServer {
+	server, err := ParseNidErr(nidStr)
+	if err != nil {
+		panic(fmt.Sprintf("ParseNid()->%v", err))
+	}
 	return server
 }
+
+// nidValue quotes a NID value if it can't be written as is.
+func nidValue(value string) string {
+	if value != "" && strings.IndexAny(value, ",='\"") < 0 {
+		return value
+	}
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// String formats the server as a NID which parses back to the same server,
+// except that the password is masked.
+func (server *MySQLServer) String() string {
+	tokens := []string{
+		"h=" + nidValue(server.Host),
+		"P=" + strconv.Itoa(server.Port)}
+	if server.Socket != "" {
+		tokens = append(tokens, "S="+nidValue(server.Socket))
+	}
+	if server.User != "" {
+		tokens = append(tokens, "u="+nidValue(server.User))
+	}
+	if server.Pass != "" {
+		tokens = append(tokens, "p=***")
+	}
+	if server.Db != "" {
+		tokens = append(tokens, "D="+nidValue(server.Db))
+	}
+	if server.Charset != "" {
+		tokens = append(tokens, "A="+nidValue(server.Charset))
+	}
+	if server.Timeout != 0 {
+		tokens = append(tokens, "T="+strconv.Itoa(server.Timeout))
+	}
+	return strings.Join(tokens, ",")
+}
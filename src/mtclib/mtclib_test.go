@@ -0,0 +1,194 @@
+package mtclib
+
+import (
+	"os"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var nidTests = []struct {
+	nid    string
+	server MySQLServer
+}{
+	{"h=db1", MySQLServer{Host: "db1", Port: 3306}},
+	{"h=db1,P=3307,u=root,p=secret",
+		MySQLServer{Host: "db1", Port: 3307, User: "root", Pass: "secret"}},
+	{"p='se,cret',u=root", MySQLServer{Host: "localhost", Port: 3306,
+		User: "root", Pass: "se,cret"}},
+	{`p="a=b",h=db1`, MySQLServer{Host: "db1", Port: 3306, Pass: "a=b"}},
+	{"p='it''s',h=db1", MySQLServer{Host: "db1", Port: 3306, Pass: "it's"}},
+	{`p="say ""hi""",h=db1`,
+		MySQLServer{Host: "db1", Port: 3306, Pass: `say "hi"`}},
+	{"h=db1,p=''", MySQLServer{Host: "db1", Port: 3306}},
+	{"S=/tmp/mysql.sock,D=shop,A=latin1,T=5",
+		MySQLServer{Host: "localhost", Port: 3306, Socket: "/tmp/mysql.sock",
+			Db: "shop", Charset: "latin1", Timeout: 5}},
+	{"h=db1,P=0", MySQLServer{Host: "db1", Port: 0}},
+	{"h=db1,P=65535", MySQLServer{Host: "db1", Port: 65535}},
+}
+
+func TestParseNid(t *testing.T) {
+	for _, test := range nidTests {
+		server, err := ParseNidErr(test.nid)
+		if err != nil {
+			t.Errorf("%v: %v", test.nid, err)
+			continue
+		}
+		want := test.server
+		server.passGiven = false
+		if *server != want {
+			t.Errorf("%v: got %#v, want %#v", test.nid, *server, want)
+		}
+	}
+}
+
+func TestPassGiven(t *testing.T) {
+	for nid, given := range map[string]bool{
+		"h=db1":        false,
+		"h=db1,p=x":    true,
+		"h=db1,p=''":   true,
+		"h=db1,u=root": false} {
+		server, err := ParseNidErr(nid)
+		if err != nil {
+			t.Errorf("%v: %v", nid, err)
+		} else if server.PassGiven() != given {
+			t.Errorf("%v: PassGiven() = %v, want %v", nid,
+				server.PassGiven(), given)
+		}
+	}
+}
+
+var nidErrorTests = []struct {
+	nid  string
+	kind int
+	key  string
+}{
+	{"", NID_MALFORMED, ""},
+	{"db1", NID_MALFORMED, ""},
+	{"h=db1,,P=3306", NID_MALFORMED, "h"},
+	{"h=db1,p=a,b,u=root", NID_MALFORMED, "p"},
+	{"p='secret,h=db1", NID_MALFORMED, "p"},
+	{"p='se'cret,h=db1", NID_MALFORMED, "p"},
+	{"x=1", NID_UNKNOWN_KEY, "x"},
+	{"h=db1,p=ab,cd=ef", NID_MALFORMED, "p"},
+	{"h=db1,p='ab',cd=ef", NID_UNKNOWN_KEY, "cd"},
+	{"hh=db1", NID_UNKNOWN_KEY, "hh"},
+	{"h=db1,h=db2", NID_DUPLICATE_KEY, "h"},
+	{"p=a,P=1,p=b", NID_DUPLICATE_KEY, "p"},
+	{"h=db1,P=65536", NID_BAD_PORT, "P"},
+	{"h=db1,P=-1", NID_BAD_PORT, "P"},
+	{"h=db1,P=port", NID_BAD_PORT, "P"},
+	{"h=,P=3306", NID_EMPTY_VALUE, "h"},
+	{"h=db1,T=-5", NID_BAD_VALUE, "T"},
+}
+
+func TestNidError(t *testing.T) {
+	for _, test := range nidErrorTests {
+		_, err := ParseNidErr(test.nid)
+		e, ok := err.(*NidError)
+		switch {
+		case !ok:
+			t.Errorf("%q: got error %v, want a *NidError", test.nid, err)
+		case e.Kind != test.kind || e.Key != test.key:
+			t.Errorf("%q: got kind %v key %q, want kind %v key %q", test.nid,
+				e.Kind, e.Key, test.kind, test.key)
+		}
+	}
+}
+
+func TestNidErrorMasksPassword(t *testing.T) {
+	for _, nid := range []string{
+		"h=db1,p=se,cret,u=root",
+		"h=db1,p=se,=cret",
+		"p=secret,h=db1,,P=1",
+		"p='secret,h=db1",
+		"h='db1,p=secret",
+		"p=a,p=secret",
+		"p=se,cret=x,h=db1",
+		"h=db1,p=se,cret=x"} {
+		_, err := ParseNidErr(nid)
+		if err == nil {
+			t.Errorf("%q: no error", nid)
+			continue
+		}
+		msg := err.String()
+		if strings.Index(msg, "cret") >= 0 {
+			t.Errorf("%q: error reveals the password: %v", nid, msg)
+		}
+	}
+}
+
+func TestNidErrorOffset(t *testing.T) {
+	for nid, want := range map[string]string{
+		"h=db1,p=a,b,u=root": "mulformed NID at byte 10, after p=***",
+		"h=db1,p=ab,cd=ef":   "mulformed NID at byte 11, after p=***"} {
+		_, err := ParseNidErr(nid)
+		if err == nil || err.String() != want {
+			t.Errorf("%q: got %v, want %v", nid, err, want)
+		}
+	}
+}
+
+func TestServerString(t *testing.T) {
+	for _, nid := range []string{
+		"h=db1,P=3306",
+		"h=db1,P=3307,u=root",
+		"h=db1,P=3306,S=/tmp/mysql.sock,u=root,D=shop,A=latin1,T=5",
+		"h='a,b',P=3306,u='it''s'"} {
+		server, err := ParseNidErr(nid)
+		if err != nil {
+			t.Errorf("%v: %v", nid, err)
+		} else if str := server.String(); str != nid {
+			t.Errorf("%v: String() = %v", nid, str)
+		}
+	}
+	server, _ := ParseNidErr("h=db1,p=secret")
+	if str := server.String(); str != "h=db1,P=3306,p=***" {
+		t.Errorf("password not masked: %v", str)
+	}
+}
+
+// Option file and inventory errors tell the file, the line and the option,
+// never the value.
+func TestOptionErrorHidesValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtclib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cnf := filepath.Join(dir, "my.cnf")
+	inv := filepath.Join(dir, "inventory")
+	files := map[string]string{
+		cnf: "[client]\nuser = root\npassword = \"s3cret\n",
+		inv: "[node db1]\nnid = 'h=db1,p=s3cret\n"}
+	for path, content := range files {
+		if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = ReadOptionFile(cnf, "client")
+	checkOptionError(t, err, cnf+":3: unterminated quote of password")
+	_, err = ParseNidErr("F=" + cnf)
+	checkOptionError(t, err, "")
+	_, err = ReadInventory(inv)
+	checkOptionError(t, err, inv+":2: unterminated quote of nid")
+	err = ioutil.WriteFile(inv, []byte("nid = h=db1,p=s3cret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadInventory(inv)
+	checkOptionError(t, err, inv+":1: option outside of a section: nid")
+}
+
+func checkOptionError(t *testing.T, err os.Error, want string) {
+	switch {
+	case err == nil:
+		t.Errorf("no error, want %v", want)
+	case strings.Index(err.String(), "s3cret") >= 0:
+		t.Errorf("error reveals the password: %v", err)
+	case want != "" && err.String() != want:
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
@@ -0,0 +1,119 @@
+package mtclib
+
+import (
+	"os"
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ReadOptionFile reads options of the given groups from a my.cnf style option
+// file, options of a later group override those of an earlier one. Option
+// names are returned with '-' replaced by '_', quotes around values are
+// removed. !include and !includedir directives are ignored.
+func ReadOptionFile(path string, groups ...string) (map[string]string,
+	os.Error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rank := make(map[string]int, len(groups))
+	for i, group := range groups {
+		rank[group] = i + 1
+	}
+	opts := make(map[string]string)
+	optRank := make(map[string]int)
+	current := 0 // rank of the current group, 0 if not wanted
+	rd := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != os.EOF {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';' || line[0] == '!':
+		case line[0] == '[':
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%v:%v: bad group: %v", path, n, line)
+			}
+			current = rank[strings.TrimSpace(line[1:len(line)-1])]
+		case current > 0:
+			name, value := line, ""
+			if i := strings.Index(line, "="); i >= 0 {
+				var verr os.Error
+				name = strings.TrimSpace(line[:i])
+				if value, verr = optionValue(line[i+1:]); verr != nil {
+					return nil, fmt.Errorf("%v:%v: %v of %v", path, n, verr,
+						name)
+				}
+			}
+			name = strings.Replace(name, "-", "_", -1)
+			if optRank[name] <= current {
+				opts[name] = value
+				optRank[name] = current
+			}
+		}
+		if err == os.EOF {
+			break
+		}
+	}
+	return opts, nil
+}
+
+// optionValue returns the value of an option line without quotes or trailing
+// comment. The error doesn't tell the value, which may be a password.
+func optionValue(str string) (string, os.Error) {
+	str = strings.TrimSpace(str)
+	if str != "" && (str[0] == '"' || str[0] == '\'') {
+		end := strings.LastIndex(str, str[:1])
+		if end == 0 {
+			return "", os.NewError("unterminated quote")
+		}
+		return str[1:end], nil
+	}
+	// a comment can start in the middle of a line
+	if i := strings.Index(str, " #"); i >= 0 {
+		str = strings.TrimSpace(str[:i])
+	}
+	return str, nil
+}
+
+// SetOptions sets login info from options read by ReadOptionFile: host,
+// port, socket, user, password, database, default_character_set and
+// connect_timeout, other options are ignored.
+func (server *MySQLServer) SetOptions(opts map[string]string) os.Error {
+	for name, value := range opts {
+		switch name {
+		case "host":
+			server.Host = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return fmt.Errorf("incorrect port: %v", value)
+			}
+			server.Port = port
+		case "socket":
+			server.Socket = value
+		case "user":
+			server.User = value
+		case "password":
+			server.Pass = value
+			server.passGiven = true
+		case "database":
+			server.Db = value
+		case "default_character_set":
+			server.Charset = value
+		case "connect_timeout":
+			timeout, err := strconv.Atoi(value)
+			if err != nil || timeout < 0 {
+				return fmt.Errorf("incorrect connect_timeout: %v", value)
+			}
+			server.Timeout = timeout
+		}
+	}
+	return nil
+}
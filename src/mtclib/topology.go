@@ -0,0 +1,522 @@
+package mtclib
+
+import (
+	"os"
+	"bufio"
+	"fmt"
+	"io"
+	"json"
+	"strconv"
+	"strings"
+
+	mysql "github.com/ziutek/mymysql/v0.3.7"
+)
+
+// how a node of a Topology was found
+const (
+	FOUND_SEED        = "seed"
+	FOUND_MASTER      = "master"      // Master_Host of a slave's status
+	FOUND_SLAVE_HOSTS = "slave hosts" // SHOW SLAVE HOSTS of its master
+	FOUND_PROCESSLIST = "processlist" // a Binlog Dump thread of its master
+)
+
+// TopoNode is a MySQL instance of a Topology. Nodes are identified by
+// "host:port" as seen by their slaves, or given by the seeds.
+type TopoNode struct {
+	Addr     string   `json:"addr"`
+	Aliases  []string `json:"aliases"` // other addresses of the same server_id
+	Found    string   `json:"found"`
+	Depth    int      `json:"depth"` // hops from the nearest seed
+	Error    string   `json:"error"` // why the node couldn't be probed
+	ServerId int64    `json:"server_id"`
+	Version  string   `json:"version"`
+	ReadOnly bool     `json:"read_only"`
+	// own binlog, empty if disabled
+	LogFile string `json:"log_file"`
+	LogPos  int64  `json:"log_pos"`
+	// replication of a slave, Master is "" if the node is not a slave
+	Master              string   `json:"master"`
+	MasterLogFile       string   `json:"master_log_file"`
+	ReadMasterLogPos    int64    `json:"read_master_log_pos"`
+	RelayMasterLogFile  string   `json:"relay_master_log_file"`
+	ExecMasterLogPos    int64    `json:"exec_master_log_pos"`
+	IORunning           string   `json:"io_running"`
+	SQLRunning          string   `json:"sql_running"`
+	SecondsBehindMaster string   `json:"seconds_behind_master"` // "" for NULL
+	Replicas            []string `json:"replicas"`
+
+	Server MySQLServer  `json:"-"` // login info
+	DB     *mysql.MySQL `json:"-"` // connection kept by Topology.Keep
+
+	via *TopoNode // master which reported this replica
+}
+
+func (node *TopoNode) String() string {
+	return node.Addr
+}
+
+// Topology discovers replication between MySQL instances from seeds, by
+// following Master_Host of 'SHOW SLAVE STATUS' upward and 'SHOW SLAVE HOSTS'
+// or Binlog Dump threads of 'SHOW PROCESSLIST' downward. A replica only seen
+// in the processlist is assumed to listen on the same port as its master.
+// Addresses found to share a server_id are merged into a single node.
+type Topology struct {
+	Masters  bool // follow masters
+	Replicas bool // follow replicas
+	Depth    int  // maximum hops from a seed, 0 for unlimited
+	Keep     bool // keep connections of probed nodes in TopoNode.DB
+	// Login returns login info of a discovered node, the default copies the
+	// user, password, charset and timeout of the first seed
+	Login func(host string, port int) MySQLServer
+	// Connect connects to a node, the default uses New and Connect
+	Connect func(server *MySQLServer) (*mysql.MySQL, os.Error)
+
+	Nodes  []*TopoNode // in order of discovery, seeds first
+	byAddr map[string]*TopoNode
+}
+
+// NewTopology returns a Topology following both masters and replicas
+// without limit.
+func NewTopology() *Topology {
+	return &Topology{
+		Masters:  true,
+		Replicas: true,
+		byAddr:   make(map[string]*TopoNode)}
+}
+
+// Node returns the node at addr or any of its aliases, or nil.
+func (t *Topology) Node(addr string) *TopoNode {
+	return t.byAddr[addr]
+}
+
+// MasterOf returns the master of node if it is part of the topology.
+func (t *Topology) MasterOf(node *TopoNode) *TopoNode {
+	if node.Master == "" {
+		return nil
+	}
+	return t.byAddr[node.Master]
+}
+
+// Roots returns nodes without a master in the topology, or all nodes of a
+// circular replication if none.
+func (t *Topology) Roots() []*TopoNode {
+	roots := make([]*TopoNode, 0, 1)
+	for _, node := range t.Nodes {
+		if t.MasterOf(node) == nil {
+			roots = append(roots, node)
+		}
+	}
+	if len(roots) == 0 && len(t.Nodes) > 0 {
+		roots = append(roots, t.Nodes[0])
+	}
+	return roots
+}
+
+// Close closes connections kept by Keep, except those taken away by setting
+// TopoNode.DB to nil.
+func (t *Topology) Close() {
+	for _, node := range t.Nodes {
+		if node.DB != nil {
+			node.DB.Close()
+			node.DB = nil
+		}
+	}
+}
+
+// SlaveStatus returns the result of 'SHOW SLAVE STATUS' as a map keyed by
+// column names, or nil if the instance isn't a slave.
+func SlaveStatus(db *mysql.MySQL) (map[string]string, os.Error) {
+	rows, res, err := db.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	status := make(map[string]string, len(res.Map))
+	for name, i := range res.Map {
+		status[name] = rows[0].Str(i)
+	}
+	return status, nil
+}
+
+// MasterOf returns the master of server from its slave status, a loopback
+// Master_Host is replaced by the host of server.
+func MasterOf(server *MySQLServer, status map[string]string) (host string,
+	port int) {
+
+	host = loopback(status["Master_Host"], server.Host)
+	port, _ = strconv.Atoi(status["Master_Port"])
+	return
+}
+
+func loopback(host, local string) string {
+	if host == "127.0.0.1" || host == "localhost" || host == "::1" {
+		return local
+	}
+	return host
+}
+
+// Discover probes the seeds and every node reachable from them, nodes
+// already known are not probed again. A node which can't be probed is kept
+// with its Error set. An error is returned only if no seed can be probed.
+func (t *Topology) Discover(seeds ...*MySQLServer) os.Error {
+	if t.byAddr == nil {
+		t.byAddr = make(map[string]*TopoNode)
+	}
+	if t.Login == nil && len(seeds) > 0 {
+		seed := seeds[0]
+		t.Login = func(host string, port int) MySQLServer {
+			return MySQLServer{Host: host, Port: port, User: seed.User,
+				Pass: seed.Pass, Charset: seed.Charset, Timeout: seed.Timeout}
+		}
+	}
+	queue := make([]*TopoNode, 0, len(seeds))
+	for _, seed := range seeds {
+		addr := fmt.Sprintf("%v:%v", seed.Host, seed.Port)
+		if t.byAddr[addr] == nil {
+			node := &TopoNode{Addr: addr, Found: FOUND_SEED, Server: *seed}
+			t.add(node)
+			queue = append(queue, node)
+		}
+	}
+	probed := 0
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if err := t.probe(node); err != nil {
+			node.Error = err.String()
+			continue
+		}
+		if dup := t.sameServer(node); dup != nil {
+			t.merge(node, dup)
+			continue
+		}
+		if node.Found == FOUND_SEED {
+			probed++
+		}
+		if t.Depth != 0 && node.Depth >= t.Depth {
+			continue
+		}
+		next := make([]*TopoNode, 0)
+		if t.Masters && node.Master != "" {
+			next = append(next, t.found(node.Master, FOUND_MASTER))
+		}
+		if t.Replicas {
+			replicas, err := t.replicas(node)
+			if err != nil {
+				node.Error = err.String()
+			}
+			for _, replica := range replicas {
+				if replica.via == nil && replica.Depth < 0 {
+					replica.via = node
+				}
+			}
+			next = append(next, replicas...)
+		}
+		for _, n := range next {
+			if n.Depth < 0 {
+				n.Depth = node.Depth + 1
+				queue = append(queue, n)
+			}
+		}
+	}
+	t.link()
+	if probed == 0 && len(seeds) > 0 {
+		seed := t.Node(fmt.Sprintf("%v:%v", seeds[0].Host, seeds[0].Port))
+		return fmt.Errorf("can't probe any seed, %v: %v", seed, seed.Error)
+	}
+	return nil
+}
+
+func (t *Topology) add(node *TopoNode) {
+	t.Nodes = append(t.Nodes, node)
+	t.byAddr[node.Addr] = node
+}
+
+// found returns the node at addr, a new one with Depth -1 if not known yet.
+func (t *Topology) found(addr, how string) *TopoNode {
+	if node := t.byAddr[addr]; node != nil {
+		return node
+	}
+	host, port, _ := SplitAddr(addr)
+	node := &TopoNode{Addr: addr, Found: how, Depth: -1,
+		Server: t.Login(host, port)}
+	t.add(node)
+	return node
+}
+
+// SplitAddr splits "host:port" as used by Topology.
+func SplitAddr(addr string) (host string, port int, err os.Error) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return addr, 0, fmt.Errorf("no port in %v", addr)
+	}
+	port, err = strconv.Atoi(addr[i+1:])
+	return addr[:i], port, err
+}
+
+func (t *Topology) connect(server *MySQLServer) (*mysql.MySQL, os.Error) {
+	if t.Connect != nil {
+		return t.Connect(server)
+	}
+	db := server.New()
+	if err := server.Connect(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// probe connects to node and reads its variables, binlog and slave status.
+// The connection is only kept by Keep if the node is probed.
+func (t *Topology) probe(node *TopoNode) (err os.Error) {
+	db, err := t.connect(&node.Server)
+	if err != nil {
+		return fmt.Errorf("can't connect: %v", err)
+	}
+	defer func() {
+		if t.Keep && err == nil {
+			node.DB = db
+		} else {
+			db.Close()
+		}
+	}()
+	rows, _, err := db.Query("SELECT @@server_id, @@version, @@read_only")
+	if err != nil {
+		return fmt.Errorf("'SELECT @@server_id': %v", err)
+	}
+	node.ServerId, _ = strconv.Atoi64(rows[0].Str(0))
+	node.Version = rows[0].Str(1)
+	node.ReadOnly = rows[0].Str(2) == "1"
+	rows, _, err = db.Query("SHOW MASTER STATUS")
+	if err != nil {
+		return fmt.Errorf("'SHOW MASTER STATUS': %v", err)
+	}
+	if len(rows) > 0 {
+		node.LogFile = rows[0].Str(0)
+		node.LogPos, _ = strconv.Atoi64(rows[0].Str(1))
+	}
+	status, err := SlaveStatus(db)
+	if err != nil {
+		return fmt.Errorf("'SHOW SLAVE STATUS': %v", err)
+	}
+	if status != nil {
+		host, port := MasterOf(&node.Server, status)
+		node.Master = fmt.Sprintf("%v:%v", host, port)
+		node.MasterLogFile = status["Master_Log_File"]
+		node.ReadMasterLogPos, _ = strconv.Atoi64(
+			status["Read_Master_Log_Pos"])
+		node.RelayMasterLogFile = status["Relay_Master_Log_File"]
+		node.ExecMasterLogPos, _ = strconv.Atoi64(
+			status["Exec_Master_Log_Pos"])
+		node.IORunning = status["Slave_IO_Running"]
+		node.SQLRunning = status["Slave_SQL_Running"]
+		node.SecondsBehindMaster = status["Seconds_Behind_Master"]
+	}
+	return nil
+}
+
+// replicas returns the replicas of node from 'SHOW SLAVE HOSTS', and from
+// Binlog Dump threads of 'SHOW PROCESSLIST' for replicas without report_host.
+func (t *Topology) replicas(node *TopoNode) ([]*TopoNode, os.Error) {
+	db := node.DB
+	if db == nil {
+		var err os.Error
+		if db, err = t.connect(&node.Server); err != nil {
+			return nil, fmt.Errorf("can't connect: %v", err)
+		}
+		defer db.Close()
+	}
+	replicas := make([]*TopoNode, 0)
+	reported := make(map[string]bool)
+	rows, res, err := db.Query("SHOW SLAVE HOSTS")
+	if err != nil {
+		return nil, fmt.Errorf("'SHOW SLAVE HOSTS': %v", err)
+	}
+	for _, row := range rows {
+		host := loopback(row.Str(res.Map["Host"]), node.Server.Host)
+		if host == "" {
+			continue
+		}
+		addr := host + ":" + row.Str(res.Map["Port"])
+		replicas = append(replicas, t.found(addr, FOUND_SLAVE_HOSTS))
+		reported[host] = true
+	}
+	rows, res, err = db.Query("SHOW PROCESSLIST")
+	if err != nil {
+		return nil, fmt.Errorf("'SHOW PROCESSLIST': %v", err)
+	}
+	for _, row := range rows {
+		if !strings.HasPrefix(row.Str(res.Map["Command"]), "Binlog Dump") {
+			continue
+		}
+		// Host is the client address
+		host := row.Str(res.Map["Host"])
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		host = loopback(host, node.Server.Host)
+		if host == "" || reported[host] {
+			continue
+		}
+		addr := fmt.Sprintf("%v:%v", host, node.Server.Port)
+		replicas = append(replicas, t.found(addr, FOUND_PROCESSLIST))
+	}
+	return replicas, nil
+}
+
+// sameServer returns another probed node with the server_id of node.
+func (t *Topology) sameServer(node *TopoNode) *TopoNode {
+	for _, n := range t.Nodes {
+		if n != node && n.Version != "" && n.ServerId == node.ServerId {
+			return n
+		}
+	}
+	return nil
+}
+
+// merge makes node an alias of dup and drops it.
+func (t *Topology) merge(node, dup *TopoNode) {
+	if node.DB != nil {
+		node.DB.Close()
+	}
+	dup.Aliases = append(dup.Aliases, node.Addr)
+	t.byAddr[node.Addr] = dup
+	for i, n := range t.Nodes {
+		if n == node {
+			t.Nodes = append(t.Nodes[:i], t.Nodes[i+1:]...)
+			break
+		}
+	}
+}
+
+// link resolves aliases of masters and lists every slave as a replica of its
+// master. A replica which couldn't be probed is linked to the master it was
+// found by.
+func (t *Topology) link() {
+	for _, node := range t.Nodes {
+		node.Replicas = make([]string, 0)
+	}
+	for _, node := range t.Nodes {
+		if node.Master == "" && node.via != nil {
+			node.Master = node.via.Addr
+		}
+		master := t.MasterOf(node)
+		if master == nil {
+			continue
+		}
+		node.Master = master.Addr
+		master.Replicas = append(master.Replicas, node.Addr)
+	}
+}
+
+// Describe returns a one line summary of node.
+func (node *TopoNode) Describe() string {
+	if node.Version == "" {
+		return fmt.Sprintf("%v: %v", node.Addr, node.Error)
+	}
+	mode := "read-write"
+	if node.ReadOnly {
+		mode = "read-only"
+	}
+	desc := fmt.Sprintf("%v server_id=%v %v %v", node.Addr, node.ServerId,
+		node.Version, mode)
+	if node.LogFile != "" {
+		desc += fmt.Sprintf(" binlog=%v:%v", node.LogFile, node.LogPos)
+	}
+	if node.Master != "" {
+		lag := node.SecondsBehindMaster
+		if lag == "" {
+			lag = "NULL"
+		}
+		desc += fmt.Sprintf(" io=%v sql=%v exec=%v:%v lag=%v",
+			node.IORunning, node.SQLRunning, node.RelayMasterLogFile,
+			node.ExecMasterLogPos, lag)
+	}
+	if node.Error != "" {
+		desc += " (" + node.Error + ")"
+	}
+	return desc
+}
+
+// WriteText writes the topology as trees from its roots down to replicas.
+func (t *Topology) WriteText(w io.Writer) os.Error {
+	bw := bufio.NewWriter(w)
+	seen := make(map[*TopoNode]bool)
+	var walk func(node *TopoNode, indent string)
+	walk = func(node *TopoNode, indent string) {
+		if seen[node] {
+			fmt.Fprintf(bw, "%v%v (circular)\n", indent, node.Addr)
+			return
+		}
+		seen[node] = true
+		fmt.Fprintf(bw, "%v%v\n", indent, node.Describe())
+		for _, addr := range node.Replicas {
+			walk(t.byAddr[addr], indent+"    ")
+		}
+	}
+	for _, root := range t.Roots() {
+		walk(root, "")
+	}
+	// nodes of circles not reached from a root
+	for _, node := range t.Nodes {
+		if !seen[node] {
+			walk(node, "")
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteJSON writes the nodes of the topology as a JSON array.
+func (t *Topology) WriteJSON(w io.Writer) os.Error {
+	data, err := json.MarshalIndent(t.Nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// WriteDOT writes the topology as a Graphviz digraph, with edges from masters
+// to replicas. Read-write nodes are drawn bold, nodes which couldn't be
+// probed dashed.
+func (t *Topology) WriteDOT(w io.Writer) os.Error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph replication {\n")
+	for _, node := range t.Nodes {
+		label := node.Addr
+		style := "solid"
+		switch {
+		case node.Version == "":
+			style = "dashed"
+		case !node.ReadOnly:
+			style = "bold"
+		}
+		if node.Version != "" {
+			label += fmt.Sprintf("\\nserver_id %v\\n%v", node.ServerId,
+				node.Version)
+		}
+		fmt.Fprintf(bw, "  %q [label=\"%v\", style=%v];\n", node.Addr,
+			label, style)
+	}
+	for _, node := range t.Nodes {
+		for _, addr := range node.Replicas {
+			replica := t.byAddr[addr]
+			label := ""
+			if replica.Version != "" {
+				label = fmt.Sprintf("io %v, sql %v", replica.IORunning,
+					replica.SQLRunning)
+				if replica.SecondsBehindMaster != "" {
+					label += fmt.Sprintf(", %vs", replica.SecondsBehindMaster)
+				}
+			}
+			fmt.Fprintf(bw, "  %q -> %q [label=%q];\n", node.Addr, addr,
+				label)
+		}
+	}
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
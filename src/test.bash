@@ -3,7 +3,10 @@
 # default applications to test
 APPS="\
 mtc-cordump \
-mtc-rplerr-monitor\
+mtc-restore \
+mtc-rplerr-monitor \
+mtc-topology \
+mtc-heartbeat\
 "
 S_APPS=""
 